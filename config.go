@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Config struct {
+	// Memcached maps a device type to one or more comma-separated addresses.
+	Memcached map[string]string `json:"memcached"`
+	// Aliases maps alternate device type names to the keys of Memcached.
+	Aliases map[string]string `json:"aliases"`
+	// KeyPrefixes maps a device type to a string prepended to its keys.
+	KeyPrefixes map[string]string `json:"key_prefixes"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	if len(cfg.Memcached) == 0 {
+		return nil, fmt.Errorf("config %s defines no memcached addresses", path)
+	}
+	for devType, addr := range cfg.Memcached {
+		if devType == "" || addr == "" {
+			return nil, fmt.Errorf("config %s has an empty device type or address", path)
+		}
+	}
+	return &cfg, nil
+}
+
+// parseAliases parses comma-separated alias=type pairs.
+func parseAliases(s string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		alias, devType, ok := strings.Cut(pair, "=")
+		alias, devType = strings.TrimSpace(alias), strings.TrimSpace(devType)
+		if !ok || alias == "" || devType == "" {
+			return nil, fmt.Errorf("invalid alias %q, expected alias=type", pair)
+		}
+		aliases[alias] = devType
+	}
+	return aliases, nil
+}
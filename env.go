@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envPrefix = "LOADER_"
+
+// envName maps a flag to its environment variable: -max-ops-per-sec is read
+// from LOADER_MAX_OPS_PER_SEC.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets flag values from the environment. It runs before the
+// command line is parsed, so an explicit flag still wins over the variable,
+// which in turn wins over the built-in default.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid %s=%q: %v", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
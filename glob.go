@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// expandPattern is filepath.Glob plus "**" path segments, which match any
+// number of nested directories. Matches are returned in sorted order.
+func expandPattern(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		files, err := filepath.Glob(pattern)
+		sort.Strings(files)
+		return files, err
+	}
+
+	segs := strings.Split(filepath.ToSlash(pattern), "/")
+	for _, seg := range segs {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, err
+		}
+	}
+	// Walk from the deepest directory that has no wildcards in it.
+	i := 0
+	for i < len(segs)-1 && !hasMeta(segs[i]) {
+		i++
+	}
+	root := filepath.FromSlash(strings.Join(segs[:i], "/"))
+	switch {
+	case root == "" && strings.HasPrefix(pattern, "/"):
+		root = "/"
+	case root == "":
+		root = "."
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			slog.Warn("Cannot read directory, skipping", "path", p, "err", err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if matchSegments(segs[i:], strings.Split(filepath.ToSlash(rel), "/")) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func hasMeta(seg string) bool {
+	return strings.ContainsAny(seg, `*?[\`)
+}
+
+func matchSegments(pattern, segs []string) bool {
+	if len(pattern) == 0 {
+		return len(segs) == 0
+	}
+	if pattern[0] == "**" {
+		for k := 0; k <= len(segs); k++ {
+			if matchSegments(pattern[1:], segs[k:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], segs[0])
+	return ok && matchSegments(pattern[1:], segs[1:])
+}
@@ -1,238 +1,829 @@
 package main
 
 import (
-	"bufio"
 	"compress/gzip"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	"google.golang.org/protobuf/proto"
-	"go_multithreading/appsinstalled"
+	"go_multithreading/loader"
+	"golang.org/x/time/rate"
 )
 
-const (
-	normalErrRate = 0.01
-)
+// Keys are spread over several servers by a stable hash of the key, so the
+// same key always goes to the same node as long as the list doesn't change.
+func newClient(addrs string) (*memcache.Client, error) {
+	ss, err := newServerList(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return memcache.NewFromSelector(ss), nil
+}
 
-type AppsInstalled struct {
-	DevType string
-	DevID   string
-	Lat     float64
-	Lon     float64
-	Apps    []uint32
+func newServerList(addrs string) (*memcache.ServerList, error) {
+	servers := splitAddrs(addrs)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no memcached address")
+	}
+	var ss memcache.ServerList
+	if err := ss.SetServers(servers...); err != nil {
+		return nil, err
+	}
+	return &ss, nil
 }
 
-type Stats struct {
-	Processed int
-	Errors    int
-	mu        sync.Mutex
+// Writes mostly wait on memcached, so automatic sizing runs a few goroutines
+// per CPU. The total is shared between the files processed in parallel so
+// -file-workers doesn't multiply it.
+const autoWorkersPerCPU = 4
+
+// lowMemBatch caps -batch with -low-mem: every worker holds a batch per
+// device type, so batches rather than the line buffer dominate memory.
+const lowMemBatch = 10
+
+func autoWorkers(fileWorkers int) int {
+	return max(1, autoWorkersPerCPU*runtime.NumCPU()/max(fileWorkers, 1))
 }
 
-func dotRename(path string) error {
-	dir, file := filepath.Split(path)
-	newPath := filepath.Join(dir, "."+file)
-	return os.Rename(path, newPath)
+// parseDelimiter accepts a single character; \t is spelled out since a literal
+// tab is awkward to pass on the command line.
+func parseDelimiter(s string) (string, error) {
+	if s == `\t` {
+		return "\t", nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return "", fmt.Errorf("%q is not a single character", s)
+	}
+	return s, nil
 }
 
-func serializeAppsInstalled(apps AppsInstalled) ([]byte, error) {
-	ua := &appsinstalled.UserApps{
-		Lat:  proto.Float64(apps.Lat),
-		Lon:  proto.Float64(apps.Lon),
-		Apps: apps.Apps,
+// parseRecordSep accepts one byte, written as is or as a Go escape such as
+// \n, \x1e or \000.
+func parseRecordSep(s string) (string, error) {
+	sep, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil || len(sep) != 1 {
+		return "", fmt.Errorf("%q is not a single byte", s)
 	}
-	return proto.Marshal(ua)
+	return sep, nil
 }
 
-func insertAppsInstalled(mc *memcache.Client, apps AppsInstalled, dryRun bool) bool {
-	if dryRun {
-		log.Printf("Dry run - would insert: %+v\n", apps)
-		return true
+func splitAddrs(addrs string) []string {
+	var servers []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			servers = append(servers, addr)
+		}
 	}
+	return servers
+}
 
-	data, err := serializeAppsInstalled(apps)
-	if err != nil {
-		log.Printf("Serialization error: %v", err)
-		return false
+// Sharing a server between device types is allowed but is more often a typo,
+// so it is only warned about.
+func warnSharedAddrs(addrs map[string]string) {
+	types := make(map[string][]string)
+	for devType, list := range addrs {
+		for _, addr := range splitAddrs(list) {
+			types[addr] = append(types[addr], devType)
+		}
+	}
+	shared := make([]string, 0, len(types))
+	for addr, devTypes := range types {
+		if len(devTypes) > 1 {
+			shared = append(shared, addr)
+		}
+	}
+	sort.Strings(shared)
+	for _, addr := range shared {
+		devTypes := types[addr]
+		sort.Strings(devTypes)
+		slog.Warn("Several device types share a memcached address", "addr", addr, "dev_types", strings.Join(devTypes, ","))
 	}
+}
 
-	item := &memcache.Item{
-		Key:   fmt.Sprintf("%s:%s", apps.DevType, apps.DevID),
-		Value: data,
+// processFiles loads the files received until files is closed in parallel and
+// runs postHook, if set, after each file loaded OK. The first file for which
+// stop returns true cancels the files in flight, which get StatusSkipped,
+// and skips the rest.
+func processFiles(parent context.Context, files <-chan string, fileWorkers int, postHook func(*loader.Result), stop func(*loader.Result) bool, mcClients map[string]*memcache.Client, opts loader.Options) []*loader.Result {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	fileQueue := make(chan string)
+	var results []*loader.Result
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < fileWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range fileQueue {
+				result, err := loader.ProcessFile(ctx, file, mcClients, opts)
+				if result.Status == loader.StatusInterrupted && parent.Err() == nil {
+					// Only stop cancels ctx without its parent, which a
+					// signal or the deadline would have.
+					result.Status = loader.StatusSkipped
+				}
+				if err != nil {
+					slog.Error("Error processing file", "file", file, "err", err)
+				}
+				if postHook != nil && err == nil && result.Status == loader.StatusOK && !opts.DryRun {
+					postHook(result)
+				}
+				if stop(result) {
+					slog.Error("Stopping on failed file", "file", file, "status", result.Status)
+					cancel()
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}()
 	}
 
-	err = mc.Set(item)
-	if err != nil {
-		log.Printf("Cannot write to memcached: %v\n", err)
-		return false
+feed:
+	for {
+		select {
+		case file, ok := <-files:
+			if !ok {
+				break feed
+			}
+			select {
+			case fileQueue <- file:
+			case <-ctx.Done():
+				slog.Warn("Run stopped, skipping remaining files")
+				break feed
+			}
+		case <-ctx.Done():
+			if len(files) > 0 {
+				slog.Warn("Run stopped, skipping remaining files")
+			}
+			break feed
+		}
 	}
-	return true
+	close(fileQueue)
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results
 }
 
-func parseAppsInstalled(line string) (*AppsInstalled, error) {
-	parts := strings.Split(line, "\t")
-	if len(parts) < 5 {
-		return nil, fmt.Errorf("invalid line format")
-	}
+// Subcommands share the load flags and differ in what is done with the
+// parsed records.
+const (
+	cmdLoad   = "load"
+	cmdVerify = "verify"
+	cmdStats  = "stats"
+)
+
+// Values of -memcache-auth.
+const (
+	authSASL = "sasl"
+	authText = "text"
+)
 
-	appsStr := strings.Split(parts[4], ",")
-	var apps []uint32
-	for _, app := range appsStr {
-		app = strings.TrimSpace(app)
-		if app == "" {
-			continue
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// splitCommand returns the subcommand and its flags. Without a subcommand the
+// flags are for load, as before subcommands were added.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case cmdLoad, cmdVerify, cmdStats:
+			return args[0], args[1:]
 		}
-		id, err := strconv.ParseUint(app, 10, 32)
+	}
+	return cmdLoad, args
+}
+
+func run(args []string) int {
+	cmd, args := splitCommand(args)
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: %s [command] [flags]
+
+Commands:
+  load    load files into memcached (the default)
+  verify  read every record of the files back from memcached and count missing or differing values
+  stats   parse and serialize the files without memcached and print counts per device type
+
+Flags:
+`, filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+
+	dry := fs.Bool("dry", false, "Dry run (don't insert to memcached)")
+	parseOnly := fs.Bool("parse-only", false, "Read and parse input without serializing or touching memcached, to measure parsing speed")
+	printKeys := fs.Bool("print-keys", false, "Print the memcached key of every record to stdout instead of writing anything (lines of parallel workers are not in input order)")
+	printSizes := fs.Bool("print-sizes", false, "With -print-keys, also print the value size in bytes after a tab")
+	drySample := fs.Int("dry-sample", 0, "In dry run, log the records of the first N lines of each file in full")
+	pattern := fs.String("pattern", "/data/appsinstalled/*.tsv.gz", "File pattern; ** matches any number of nested directories")
+	order := fs.String("order", defaultOrder, "Order of -pattern files: name, mtime or size, each -asc or -desc (a -manifest keeps its own order)")
+	manifest := fs.String("manifest", "", "Text file listing input paths one per line, processed in that order (overrides -pattern)")
+	watch := fs.Bool("watch", false, "Keep running and load new files matching -pattern as they arrive, until interrupted")
+	watchDirFlag := fs.String("watch-dir", "", "Directory to watch with -watch, matching file names with the last element of -pattern (default: the directory of -pattern)")
+	watchSettle := fs.Duration("watch-settle", 2*time.Second, "How long a new file must go without writes before -watch loads it")
+	stdin := fs.Bool("stdin", false, "Read uncompressed TSV from stdin instead of -pattern files")
+	configPath := fs.String("config", "", "JSON file mapping device types to memcached addresses (overrides -idfa/-gaid/-adid/-dvid)")
+	idfa := fs.String("idfa", "127.0.0.1:33013", "IDFA memcached address(es), comma-separated")
+	gaid := fs.String("gaid", "127.0.0.1:33014", "GAID memcached address(es), comma-separated")
+	adid := fs.String("adid", "127.0.0.1:33015", "ADID memcached address(es), comma-separated")
+	dvid := fs.String("dvid", "127.0.0.1:33016", "DVID memcached address(es), comma-separated")
+	mcUser := fs.String("memcache-user", "", "Username to authenticate to memcached with, see -memcache-auth (no authentication if empty)")
+	mcAuth := fs.String("memcache-auth", authSASL, "How -memcache-user authenticates: sasl for binary-protocol SASL PLAIN (a server run with -S; commands are then sent in the binary protocol) or text for text-protocol auth (a server run with -Y <authfile>)")
+	mcTimeout := fs.Duration("memcache-timeout", memcache.DefaultTimeout, "Socket read/write timeout of memcached operations")
+	mcIdleConns := fs.Int("memcache-idle-conns", 0, "Idle connections kept per memcached server (0 keeps one per concurrent write: workers*file-workers, times -batch-concurrency when -batch > 1)")
+	preconnect := fs.Bool("preconnect", true, "Open -memcache-idle-conns connections to every server before loading so connection setup and errors happen up front")
+	mcPass := fs.String("memcache-pass", "", "Password of -memcache-user")
+	metricsAddr := fs.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9100 (disabled if empty)")
+	partitionByType := fs.Bool("partition-by-type", false, "Give each device type its own share of -workers writers so backends don't share writer goroutines (records are still parsed by -workers goroutines)")
+	workers := fs.Int("workers", 8, "Number of worker goroutines per file (0 picks it from the CPU count); 1 writes lines in input order with -batch 1, or in input order per device type with -batch-concurrency 1, unless -partition-by-type is set")
+	crossDupes := fs.Bool("detect-cross-dupes", false, "Warn about keys found in more than one file (keeps every unique key of the run in memory)")
+	dedup := fs.Bool("dedup", false, "Write only the last record for each key in a file (buffers every unique key of the file in memory)")
+	buffer := fs.Int("buffer", 10000, "Capacity of the channel between the file reader and workers")
+	recordSep := fs.String("record-sep", `\n`, "Byte ending each record, as is or escaped like \\x1e; with a separator other than newline records may span several lines")
+	maxLine := fs.Int("max-line", 1<<20, "Longest accepted input line in bytes; longer lines are counted as errors and skipped")
+	topSizes := fs.Int("top-sizes", 10, "Number of largest serialized records to report with their keys in the log and -summary (0 disables)")
+	filter := fs.String("filter", "", "Regexp a record's -filter-field must match to be loaded; other records are skipped, not counted as errors")
+	filterField := fs.String("filter-field", loader.FilterDevID, "Field -filter applies to: dev_id or dev_type (after -normalize and -aliases)")
+	sampleRate := fs.Float64("sample-rate", 1, "Load only this random share of the lines, from 0 to 1; the same -sample-seed picks the same lines every run")
+	sampleSeed := fs.Uint64("sample-seed", 1, "Seed choosing the lines of -sample-rate")
+	limit := fs.Int("limit", 0, "Read only the first N lines of each file and leave files cut short unrenamed, for smoke tests (0 reads everything)")
+	warnEmpty := fs.Bool("warn-empty", false, "Treat files with only blank, comment or header lines as a warning: status empty and left in place, without failing the run (by default they are loaded successfully)")
+	lowMem := fs.Bool("low-mem", false, "Shrink -buffer to one line per worker, -batch to 10 and gzip read-ahead to 2 blocks of 256KB so the reader blocks until workers catch up (memory per file is roughly (buffer + batch*types*workers) * avg_line_size plus the read-ahead)")
+	fileWorkers := fs.Int("file-workers", 4, "Number of files processed in parallel")
+	continueOnDecompress := fs.Bool("continue-on-decompress-error", true, "Go on with the other files when one can't be decompressed; false stops the run like -fail-fast")
+	failFast := fs.Bool("fail-fast", false, "Stop at the first file that fails or exceeds -err-rate, leaving the rest unprocessed")
+	batchSize := fs.Int("batch", 1000, "Number of items per memcached write batch")
+	batchConcurrency := fs.Int("batch-concurrency", 4, "Items of a batch written at once, each on its own memcached connection")
+	postHook := fs.String("post-hook", "", "Shell command run after each file loaded OK, with the file's path after -done-action as its argument and its results in MEMC_LOAD_* environment variables")
+	doneAction := fs.String("done-action", loader.DoneRename, "What to do with a loaded file: rename (prefix with a dot), none, or move:<dir>")
+	cas := fs.Bool("cas", false, "In set mode, write with gets and compare-and-swap and keep a stored value from a later line or file, so the last record of a key wins whatever the worker order; values get the -with-header header with the write order (off: plain set; merge mode always uses compare-and-swap)")
+	mode := fs.String("mode", loader.ModeSet, "Write mode: set overwrites keys, add only writes keys that don't exist yet, merge adds the app ids to the stored ones (read and compare-and-swap per record)")
+	batchFlushInterval := fs.Duration("batch-flush-interval", time.Second, "Send a partial batch once its oldest item has waited this long (0 disables)")
+	retries := fs.Int("retries", 3, "Number of retries for transient memcached errors")
+	strictApps := fs.Bool("strict-apps", false, "Reject the whole line if any app id is invalid instead of skipping it")
+	strictGeo := fs.Bool("strict-geo", false, "Reject latitude outside [-90, 90] and longitude outside [-180, 180]")
+	normalize := fs.Bool("normalize", false, "Lowercase the device type before looking up its memcached address")
+	aliasSpec := fs.String("aliases", "", "Comma-separated alias=type pairs mapping other device type spellings or codes, e.g. IDFA=idfa,1=gaid (added to the config's aliases)")
+	delimiter := fs.String("delimiter", `\t`, "Single character separating the fields of a line")
+	appsDelimiter := fs.String("apps-delimiter", ",", "Single character separating app ids")
+	minApps := fs.Int("min-apps", 0, "Reject records with fewer app ids (1 rejects empty lists)")
+	maxApps := fs.Int("max-apps", 0, "Reject records with more app ids (0 disables)")
+	strictUTF8 := fs.Bool("strict-utf8", false, "Reject lines with invalid UTF-8 instead of loading them as is")
+	strictFields := fs.Bool("strict-fields", false, "Reject lines with extra non-empty columns after the apps field instead of ignoring them")
+	skipHealthcheck := fs.Bool("skip-healthcheck", false, "Don't check that memcached backends are reachable before loading")
+	debug := fs.Bool("debug", false, "Log every line that fails to parse (same as -log-level debug)")
+	quiet := fs.Bool("quiet", false, "Log only warnings and errors while loading, then the final totals")
+	logLevel := fs.String("log-level", "info", "Minimum level of log messages: debug, info, warn or error")
+	errRate := fs.Float64("err-rate", loader.DefaultErrRate, "Maximum acceptable share of failed records among all attempted, per file and per device type")
+	ttl := fs.Int("ttl", 0, "Expiration of written items in seconds (0 never expires, over 30 days is a Unix timestamp)")
+	maxOps := fs.Int("max-ops-per-sec", 0, "Cap on memcached writes per second across all workers (0 disables)")
+	sinkSpec := fs.String("sink", "memcache", "Where records go: memcache, or file:<path> for a length-prefixed record file (see loader.FileSinkReader)")
+	breakerFailures := fs.Int("breaker-failures", 0, "Consecutive failed writes after which a backend is skipped for -breaker-cooldown (0 disables)")
+	breakerCooldown := fs.Duration("breaker-cooldown", 10*time.Second, "How long writes to a tripped backend fail fast before a probe write")
+	dlqPath := fs.String("dlq", "", "Gzipped file to append failed lines to, each preceded by a # reason comment")
+	outputLevel := fs.Int("output-compression-level", gzip.DefaultCompression, "Gzip level of written files such as -dlq, from 0 (none) to 9 (smallest), or -1 for the default")
+	chunkSize := fs.Int("chunk-size", 0, "Commit each file in chunks of N lines: the checkpoint advances once a chunk is written, and a chunk reaching -err-rate stops the file for retry from that chunk (0 disables)")
+	checkpointEvery := fs.Int("checkpoint-every", 0, "Save a resume checkpoint next to each file every N lines (0 disables)")
+	progressInterval := fs.Duration("progress-interval", 5*time.Second, "How often to log progress for each file (0 disables)")
+	timeout := fs.Duration("timeout", 0, "Deadline for the whole run; unfinished files are left for retry (0 disables)")
+	summaryPath := fs.String("summary", "", "Write a JSON summary of the run to this file")
+	logFormat := fs.String("log-format", "text", "Log output format: text or json")
+	format := fs.String("format", "protobuf", "Encoding of stored values: protobuf or json")
+	compressValues := fs.Bool("compress-values", false, "Prefix values with a header byte and gzip those of at least -compress-threshold bytes (decode with loader.DecodeValue)")
+	withHeader := fs.Bool("with-header", false, "Prefix values with a version and format header (decode with loader.DecodeHeader)")
+	compressThreshold := fs.Int("compress-threshold", loader.DefaultCompressThreshold, "Minimum serialized size in bytes to gzip with -compress-values")
+	verify := fs.Bool("verify", false, "Read back a random sample of written items and count missing or differing ones")
+	truncateOversize := fs.Bool("truncate-oversize", false, "Write records memcached rejects as too large again with only as many apps as should fit in 1MB")
+	diff := fs.Bool("diff", false, "Read the stored value of every record and count new, changed and unchanged keys instead of writing")
+	verifyRate := fs.Float64("verify-rate", 0.01, "Fraction of written items to read back with -verify")
+	keyTemplate := fs.String("key-template", loader.DefaultKeyTemplate, "Go text/template for memcached keys with fields DevType and DevID")
+	if err := applyEnv(fs); err != nil {
+		fatal(err)
+	}
+	fs.Parse(args)
+	switch cmd {
+	case cmdStats:
+		*dry, *skipHealthcheck = true, true
+	case cmdVerify:
+		*verify = true
+	}
+
+	if *outputLevel < gzip.DefaultCompression || *outputLevel > gzip.BestCompression {
+		fatal(fmt.Errorf("invalid -output-compression-level %d, want -1 to 9", *outputLevel))
+	}
+	var filterRe *regexp.Regexp
+	if *filter != "" {
+		re, err := regexp.Compile(*filter)
 		if err != nil {
-			continue
+			fatal(fmt.Errorf("invalid -filter: %v", err))
 		}
-		apps = append(apps, uint32(id))
+		filterRe = re
+	}
+	if *topSizes < 0 {
+		fatal(fmt.Errorf("invalid -top-sizes %d", *topSizes))
+	}
+	if *filterField != loader.FilterDevID && *filterField != loader.FilterDevType {
+		fatal(fmt.Errorf("invalid -filter-field %q, want dev_id or dev_type", *filterField))
+	}
+	if *sampleRate <= 0 || *sampleRate > 1 {
+		fatal(fmt.Errorf("invalid -sample-rate %v, want more than 0 and at most 1", *sampleRate))
+	}
+	if *ttl < 0 || *ttl > math.MaxInt32 {
+		fatal(fmt.Errorf("invalid -ttl %d", *ttl))
 	}
 
-	lat, err := strconv.ParseFloat(parts[2], 64)
+	delim, err := parseDelimiter(*delimiter)
 	if err != nil {
-		return nil, fmt.Errorf("invalid latitude: %v", err)
+		fatal(fmt.Errorf("invalid -delimiter: %v", err))
 	}
-	lon, err := strconv.ParseFloat(parts[3], 64)
+	sep, err := parseRecordSep(*recordSep)
 	if err != nil {
-		return nil, fmt.Errorf("invalid longitude: %v", err)
+		fatal(fmt.Errorf("invalid -record-sep: %v", err))
+	}
+	appsDelim, err := parseDelimiter(*appsDelimiter)
+	if err != nil {
+		fatal(fmt.Errorf("invalid -apps-delimiter: %v", err))
+	}
+	if delim == appsDelim {
+		fatal(fmt.Errorf("-delimiter and -apps-delimiter must differ"))
 	}
 
-	return &AppsInstalled{
-		DevType: parts[0],
-		DevID:   parts[1],
-		Lat:     lat,
-		Lon:     lon,
-		Apps:    apps,
-	}, nil
-}
-
+	if err := loader.ValidateDoneAction(*doneAction); err != nil {
+		fatal(fmt.Errorf("invalid -done-action: %v", err))
+	}
 
-func processFile(filename string, mcClients map[string]*memcache.Client, dryRun bool, workers int) error {
-    log.Printf("Processing file: %s", filename)
-	file, err := os.Open(filename)
+	sortOrder, err := parseOrder(*order)
 	if err != nil {
-		return err
+		fatal(err)
+	}
+	if *mcAuth != authSASL && *mcAuth != authText {
+		fatal(fmt.Errorf("invalid -memcache-auth %q, want sasl or text", *mcAuth))
+	}
+	if *mode != loader.ModeSet && *mode != loader.ModeAdd && *mode != loader.ModeMerge {
+		fatal(fmt.Errorf("invalid -mode %q, want set, add or merge", *mode))
+	}
+	if *mode == loader.ModeMerge && cmd == cmdLoad && *verify {
+		fatal(fmt.Errorf("-verify compares values with the written ones and can't be used with -mode merge"))
 	}
-	defer file.Close()
 
-	gz, err := gzip.NewReader(file)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal(fmt.Errorf("invalid -log-level %q, want debug, info, warn or error", *logLevel))
+	}
+	if *debug {
+		level = slog.LevelDebug
+	}
+	// -quiet raises the level until the run is over, so the totals are still
+	// logged.
+	var runLevel slog.LevelVar
+	runLevel.Set(level)
+	if *quiet {
+		runLevel.Set(max(level, slog.LevelWarn))
+	}
+	runID := newRunID()
+	if err := setupLogger(*logFormat, &runLevel, runID); err != nil {
+		fatal(err)
+	}
+
+	if *workers <= 0 {
+		*workers = autoWorkers(*fileWorkers)
+		slog.Info("Workers chosen automatically", "workers", *workers, "file_workers", *fileWorkers, "cpus", runtime.NumCPU())
+	}
+	if *lowMem {
+		if *dedup {
+			fatal(fmt.Errorf("-low-mem cannot be combined with -dedup"))
+		}
+		*buffer = max(*workers, 1)
+		*batchSize = min(*batchSize, lowMemBatch)
+	}
+
+	addrs := map[string]string{
+		"idfa": *idfa,
+		"gaid": *gaid,
+		"adid": *adid,
+		"dvid": *dvid,
+	}
+	aliases := make(map[string]string)
+	var keyPrefixes map[string]string
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fatal(err)
+		}
+		addrs = cfg.Memcached
+		for alias, devType := range cfg.Aliases {
+			aliases[alias] = devType
+		}
+		keyPrefixes = cfg.KeyPrefixes
+	}
+	for devType, prefix := range keyPrefixes {
+		if _, ok := addrs[devType]; !ok {
+			fatal(fmt.Errorf("key prefix for unknown device type %s", devType))
+		}
+		if err := loader.ValidateKeyPrefix(prefix); err != nil {
+			fatal(fmt.Errorf("invalid key prefix for %s: %v", devType, err))
+		}
+	}
+	flagAliases, err := parseAliases(*aliasSpec)
 	if err != nil {
-		return err
+		fatal(err)
+	}
+	for alias, devType := range flagAliases {
+		aliases[alias] = devType
+	}
+	for alias, devType := range aliases {
+		if _, ok := addrs[devType]; !ok {
+			fatal(fmt.Errorf("alias %s maps to unknown device type %s", alias, devType))
+		}
 	}
-	defer gz.Close()
 
-	stats := Stats{}
-	lines := make(chan string, 10000)
-	var wg sync.WaitGroup
+	if *batchConcurrency < 1 {
+		fatal(fmt.Errorf("invalid -batch-concurrency %d", *batchConcurrency))
+	}
+	// The library default of 2 idle connections makes most writers of a bulk
+	// load dial a fresh connection for every item.
+	if *mcIdleConns <= 0 {
+		*mcIdleConns = *workers * max(*fileWorkers, 1)
+		if *batchSize > 1 {
+			*mcIdleConns *= *batchConcurrency
+		}
+	}
+	warnSharedAddrs(addrs)
+	mcClients := make(map[string]*memcache.Client, len(addrs))
+	for devType, addr := range addrs {
+		mc, err := newClient(addr)
+		if err != nil {
+			fatal(fmt.Errorf("%s: %v", devType, err))
+		}
+		mc.Timeout = *mcTimeout
+		mc.MaxIdleConns = *mcIdleConns
+		switch {
+		case *mcUser == "":
+		case *mcAuth == authText:
+			mc.DialContext = loader.TextAuthDialer(*mcUser, *mcPass)
+		default:
+			mc.DialContext = loader.SASLDialer(*mcUser, *mcPass)
+		}
+		mcClients[devType] = mc
+	}
 
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for line := range lines {
-				line = strings.TrimSpace(line)
-				if line == "" {
-					continue
-				}
+	var fileSinkPath string
+	switch {
+	case *sinkSpec == "memcache":
+	case strings.HasPrefix(*sinkSpec, "file:") && len(*sinkSpec) > len("file:"):
+		fileSinkPath = strings.TrimPrefix(*sinkSpec, "file:")
+	default:
+		fatal(fmt.Errorf("invalid -sink %q, want memcache or file:<path>", *sinkSpec))
+	}
+	if *mode == loader.ModeMerge && fileSinkPath != "" {
+		fatal(fmt.Errorf("-mode merge reads stored values and needs the memcache sink"))
+	}
+	if *cas && (*mode != loader.ModeSet || fileSinkPath != "" || *diff || cmd == cmdVerify) {
+		fatal(fmt.Errorf("-cas orders set mode writes by reading stored values and can't be combined with -mode add or merge, -sink file:, -diff or verify"))
+	}
+	if *printKeys && (*parseOnly || cmd == cmdVerify) {
+		fatal(fmt.Errorf("-print-keys needs serialized records and can't be combined with -parse-only or verify"))
+	}
+	if cmd == cmdVerify && (fileSinkPath != "" || *dry || *parseOnly) {
+		fatal(fmt.Errorf("verify reads from memcached and can't be combined with -sink file:, -dry or -parse-only"))
+	}
+	if *chunkSize < 0 {
+		fatal(fmt.Errorf("invalid -chunk-size %d", *chunkSize))
+	}
+	if *chunkSize > 0 {
+		if *checkpointEvery > 0 && *checkpointEvery != *chunkSize {
+			fatal(fmt.Errorf("-chunk-size sets the checkpoint interval and can't differ from -checkpoint-every"))
+		}
+		if *stdin || *dedup || *dry || *parseOnly || *printKeys || cmd != cmdLoad || *diff {
+			fatal(fmt.Errorf("-chunk-size needs checkpoints and can't be combined with -stdin, -dedup, -dry, -parse-only, -print-keys, -diff or other commands"))
+		}
+		*checkpointEvery = *chunkSize
+	}
+	watchDir, watchPattern := *watchDirFlag, filepath.Base(*pattern)
+	if *watch {
+		if *stdin || *manifest != "" {
+			fatal(fmt.Errorf("-watch reads files from a directory and can't be combined with -stdin or -manifest"))
+		}
+		if watchDir == "" {
+			watchDir = filepath.Dir(*pattern)
+		}
+		if hasMeta(watchDir) {
+			fatal(fmt.Errorf("-watch needs -pattern with wildcards only in the file name, or -watch-dir"))
+		}
+		if _, err := filepath.Match(watchPattern, ""); err != nil {
+			fatal(fmt.Errorf("invalid -pattern for -watch: %v", err))
+		}
+	}
+	if *diff && (cmd != cmdLoad || *verify || *mode == loader.ModeMerge || fileSinkPath != "" || *dry || *parseOnly || *printKeys) {
+		fatal(fmt.Errorf("-diff reads from memcached instead of loading and can't be combined with -verify, -mode merge, -sink file:, -dry, -parse-only, -print-keys or other commands"))
+	}
 
-				apps, err := parseAppsInstalled(line)
-				if err != nil {
-					stats.mu.Lock()
-					stats.Errors++
-					stats.mu.Unlock()
-					continue
-				}
+	if !*skipHealthcheck && !*parseOnly && !*printKeys && fileSinkPath == "" {
+		if err := loader.HealthCheck(mcClients); err != nil {
+			fatal(err)
+		}
+	}
+	if *preconnect && !*dry && !*parseOnly && !*printKeys && fileSinkPath == "" {
+		start := time.Now()
+		if err := loader.Preconnect(mcClients, *mcIdleConns); err != nil {
+			fatal(err)
+		}
+		slog.Info("Preconnected to memcached", "conns_per_server", *mcIdleConns, "elapsed", time.Since(start).String())
+	}
 
-				mc, ok := mcClients[apps.DevType]
-				if !ok {
-					log.Printf("Unknown device type: %s", apps.DevType)
-					stats.mu.Lock()
-					stats.Errors++
-					stats.mu.Unlock()
-					continue
-				}
+	opts := loader.Options{
+		Parse: loader.ParseOptions{
+			StrictApps:   *strictApps,
+			StrictGeo:    *strictGeo,
+			StrictFields: *strictFields,
+			StrictUTF8:   *strictUTF8,
+			Normalize:    *normalize,
+			Aliases:      aliases,
+			MinApps:      *minApps,
+			MaxApps:      *maxApps,
+
+			Delimiter:     delim,
+			AppsDelimiter: appsDelim,
+		},
+		ErrRate:   *errRate,
+		DryRun:    *dry || *parseOnly || *printKeys,
+		ParseOnly: *parseOnly,
+		DrySample: *drySample,
+		Dedup:     *dedup,
+		Workers:   *workers,
+		Buffer:    *buffer,
+		MaxLine:   *maxLine,
+		LowMem:    *lowMem,
+		RecordSep: sep,
+		Limit:     *limit,
+		WarnEmpty: *warnEmpty,
+		BatchSize: *batchSize,
+		Retries:   *retries,
+		TTL:       int32(*ttl),
+
+		PartitionByType: *partitionByType,
+		CAS:             *cas,
+		SampleRate:      *sampleRate,
+		SampleSeed:      *sampleSeed,
+
+		Mode:              *mode,
+		TruncateOversize:  *truncateOversize,
+		DoneAction:        *doneAction,
+		CompressValues:    *compressValues,
+		CompressThreshold: *compressThreshold,
+		WithHeader:        *withHeader,
+
+		CheckpointEvery:    *checkpointEvery,
+		ChunkSize:          *chunkSize,
+		Filter:             filterRe,
+		FilterField:        *filterField,
+		TopSizes:           *topSizes,
+		ProgressInterval:   *progressInterval,
+		BatchFlushInterval: *batchFlushInterval,
+		BatchConcurrency:   *batchConcurrency,
+	}
 
-				ok = insertAppsInstalled(mc, *apps, dryRun)
-				stats.mu.Lock()
-				if ok {
-					stats.Processed++
-				} else {
-					stats.Errors++
-				}
-				stats.mu.Unlock()
-			}
-		}()
+	tmpl, err := loader.ParseKeyTemplate(*keyTemplate)
+	if err != nil {
+		fatal(fmt.Errorf("invalid -key-template: %v", err))
 	}
+	opts.KeyTemplate = tmpl
+	opts.KeyPrefixes = keyPrefixes
 
-	scanner := bufio.NewScanner(gz)
-	var lineCount int
-    for scanner.Scan() {
-        lineCount++
-        lines <- scanner.Text()
-    }
-    log.Printf("Read %d lines from %s", lineCount, filename)
-    close(lines)
+	opts.VerifyOnly = cmd == cmdVerify
+	opts.Diff = *diff
+	if *verify {
+		opts.VerifyRate = *verifyRate
+	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+	serializer, err := loader.NewSerializer(*format)
+	if err != nil {
+		fatal(fmt.Errorf("invalid -format: %v", err))
 	}
+	opts.Serializer = serializer
 
-	wg.Wait()
+	if *breakerFailures > 0 {
+		opts.Breakers = make(map[string]*loader.CircuitBreaker, len(mcClients))
+		for devType := range mcClients {
+			opts.Breakers[devType] = loader.NewCircuitBreaker(devType, *breakerFailures, *breakerCooldown)
+		}
+	}
 
-	if stats.Processed == 0 {
-		return dotRename(filename)
+	if *crossDupes {
+		opts.CrossDupes = loader.NewKeyTracker()
 	}
 
-	errRate := float64(stats.Errors) / float64(stats.Processed)
-	if errRate < normalErrRate {
-		log.Printf("Acceptable error rate (%.4f). Successful load\n", errRate)
-	} else {
-		log.Printf("High error rate (%.4f > %.4f). Failed load\n", errRate, normalErrRate)
+	if *maxOps > 0 {
+		opts.Limiter = rate.NewLimiter(rate.Limit(*maxOps), *maxOps)
 	}
 
-	return dotRename(filename)
-}
+	if fileSinkPath != "" {
+		sink, err := loader.CreateFileSink(fileSinkPath)
+		if err != nil {
+			fatal(err)
+		}
+		opts.Sink = sink
+		defer func() {
+			if err := sink.Close(); err != nil {
+				slog.Error("Cannot close sink file", "path", fileSinkPath, "err", err)
+			}
+		}()
+	}
 
-func main() {
+	if *printKeys {
+		opts.KeyPrinter = loader.NewKeyPrinter(os.Stdout, *printSizes)
+		defer opts.KeyPrinter.Flush()
+	}
+
+	if *dlqPath != "" {
+		dlq, err := loader.OpenDeadLetterQueue(*dlqPath, *outputLevel)
+		if err != nil {
+			fatal(err)
+		}
+		opts.DLQ = dlq
+		defer func() {
+			if err := dlq.Close(); err != nil {
+				slog.Error("Cannot close dead-letter file", "path", *dlqPath, "err", err)
+			}
+		}()
+	}
 
-	dry := flag.Bool("dry", false, "Dry run (don't insert to memcached)")
-	pattern := flag.String("pattern", "/data/appsinstalled/*.tsv.gz", "File pattern")
-	idfa := flag.String("idfa", "127.0.0.1:33013", "IDFA memcached address")
-	gaid := flag.String("gaid", "127.0.0.1:33014", "GAID memcached address")
-	adid := flag.String("adid", "127.0.0.1:33015", "ADID memcached address")
-	dvid := flag.String("dvid", "127.0.0.1:33016", "DVID memcached address")
-	workers := flag.Int("workers", 8, "Number of worker goroutines")
-	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	mcClients := map[string]*memcache.Client{
-		"idfa": memcache.New(*idfa),
-		"gaid": memcache.New(*gaid),
-		"adid": memcache.New(*adid),
-		"dvid": memcache.New(*dvid),
+	if *metricsAddr != "" {
+		server := loader.ServeMetrics(ctx, *metricsAddr)
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		}()
 	}
 
 	startTime := time.Now()
+	var results []*loader.Result
+	matched := 0
+	summaryOut := &summaryWriter{path: *summaryPath, runID: runID}
+	defer func() {
+		if summaryOut.written {
+			return
+		}
+		summary := newRunSummary(totalStats(results), results, matched, time.Since(startTime), true, *errRate)
+		if err := summaryOut.write(summary); err != nil {
+			slog.Error("Cannot write summary", "path", *summaryPath, "err", err)
+		}
+	}()
 
-	files, err := filepath.Glob(*pattern)
-	if err != nil {
-		log.Fatal(err)
+	if *stdin {
+		matched = 1
+		result, err := loader.ProcessReader(ctx, "stdin", os.Stdin, mcClients, opts)
+		if err != nil {
+			slog.Error("Error processing stdin", "err", err)
+		}
+		results = append(results, result)
+	} else {
+		var files []string
+		var err error
+		if *watch {
+			files, err = expandPattern(filepath.Join(watchDir, watchPattern))
+			files = slices.DeleteFunc(files, func(file string) bool {
+				return strings.HasPrefix(filepath.Base(file), ".")
+			})
+			sortFiles(files, sortOrder)
+		} else if *manifest != "" {
+			files, err = readManifest(*manifest)
+		} else if files, err = expandPattern(*pattern); err == nil {
+			sortFiles(files, sortOrder)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		matched = len(files)
+		queue := make(chan string, len(files))
+		for _, file := range files {
+			queue <- file
+		}
+		close(queue)
+		var input <-chan string = queue
+		if *watch {
+			if input, err = watchFiles(ctx, watchDir, watchPattern, *watchSettle, files); err != nil {
+				fatal(err)
+			}
+		}
+		stop := func(result *loader.Result) bool {
+			if result.DecompressError && !*continueOnDecompress {
+				return true
+			}
+			return *failFast && fileOutcome(result) == outcomeFailed
+		}
+		var hook func(*loader.Result)
+		if *postHook != "" {
+			hook = func(result *loader.Result) { runPostHook(*postHook, runID, result) }
+		}
+		results = processFiles(ctx, input, *fileWorkers, hook, stop, mcClients, opts)
+		if *watch {
+			matched = len(results)
+		}
+		var failed []string
+		for _, result := range results {
+			if fileOutcome(result) == outcomeFailed {
+				failed = append(failed, result.Name)
+			}
+		}
+		slog.Info("Files", "matched", matched, "failed", len(failed))
+		for _, file := range failed {
+			slog.Warn("File failed to load", "file", file)
+		}
 	}
 
-	for _, file := range files {
-		err := processFile(file, mcClients, *dry, *workers)
-		if err != nil {
-			log.Printf("Error processing file %s: %v", file, err)
+	runLevel.Set(level)
+	total := totalStats(results)
+
+	if *dry {
+		total.WriteDryRunReport(os.Stdout)
+	}
+	if opts.CrossDupes != nil {
+		opts.CrossDupes.Report()
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		slog.Warn("Run timed out, unfinished files are left for retry", "timeout", timeout.String())
+	}
+	slog.Info("Total", "processed", total.Processed, "errors", total.Errors)
+	if *parseOnly {
+		lines := 0
+		for _, result := range results {
+			lines += result.Lines
 		}
+		slog.Info("Parse only", "lines", lines, "lines_per_sec", float64(lines)/time.Since(startTime).Seconds(),
+			"parse_errors", total.ParseErrors)
+	}
+	if *mode == loader.ModeAdd {
+		slog.Info("Skipped existing keys", "count", total.SkippedExisting)
+	}
+	if filterRe != nil {
+		slog.Info("Filtered out records", "count", total.FilteredOut, "filter", *filter, "field", *filterField)
+	}
+	if *sampleRate < 1 {
+		slog.Info("Sampled out lines", "count", total.SampledOut, "rate", *sampleRate, "seed", *sampleSeed)
+	}
+	if *verify {
+		slog.Info("Verification", "failures", total.VerifyFailures)
+	}
+	if total.TooLarge > 0 {
+		slog.Warn("Items too large for memcached", "count", total.TooLarge, "truncated", total.TooLargeTruncated)
+	}
+	if *diff {
+		slog.Info("Diff against memcached", "new", total.DiffNew, "changed", total.DiffChanged, "unchanged", total.DiffUnchanged)
+	}
+	if *minApps > 0 || *maxApps > 0 {
+		slog.Info("App count out of bounds", "too_few", total.TooFewApps, "too_many", total.TooManyApps)
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("Execution time: %s\n", elapsed)
-}
\ No newline at end of file
+	slog.Info("Execution time", "elapsed", elapsed.String())
+
+	// A signal is how a watch ends, so it only marks files it cut short.
+	summary := newRunSummary(total, results, matched, elapsed, ctx.Err() != nil && !*watch, *errRate)
+	if !*dry && !opts.VerifyOnly && !opts.Diff {
+		logTypeBytes(summary)
+		logSetLatency(summary)
+	}
+	logLargest(summary)
+	slog.Info("Run totals", "files", matched, "files_processed", summary.FilesProcessed,
+		"files_skipped", summary.FilesSkipped, "files_failed", summary.FilesFailed, "files_decompress_failed", summary.FilesCorrupt, "files_empty", summary.FilesEmpty,
+		"processed", summary.Processed, "errors", summary.Errors, "bytes", summary.Bytes)
+	if summary.ErrRate >= *errRate && summary.Processed+summary.Skipped+summary.Errors > 0 {
+		slog.Warn("High error rate for the run", "err_rate", summary.ErrRate, "threshold", *errRate)
+	}
+	if err := summaryOut.write(summary); err != nil {
+		slog.Error("Cannot write summary", "path", *summaryPath, "err", err)
+		return 1
+	}
+	if !summary.Success || (opts.VerifyOnly && total.VerifyFailures > 0) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSplitAddrs(t *testing.T) {
+	tests := []struct {
+		addrs string
+		want  []string
+	}{
+		{"127.0.0.1:33013", []string{"127.0.0.1:33013"}},
+		{"a:1,b:2", []string{"a:1", "b:2"}},
+		{" a:1 , ,b:2,", []string{"a:1", "b:2"}},
+		{"", nil},
+		{" , ", nil},
+	}
+	for _, tt := range tests {
+		if got := splitAddrs(tt.addrs); !slices.Equal(got, tt.want) {
+			t.Errorf("splitAddrs(%q) = %q, want %q", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestServerListDistribution(t *testing.T) {
+	const addrs = "127.0.0.1:33013,127.0.0.1:33023,127.0.0.1:33033"
+	const keys = 3000
+	ss, err := newServerList(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := newServerList(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perServer := make(map[string]int)
+	for i := range keys {
+		key := fmt.Sprintf("idfa:%032x", i)
+		addr, err := ss.PickServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		same, err := again.PickServer(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same.String() != addr.String() {
+			t.Fatalf("key %s went to %s, then to %s with the same list", key, addr, same)
+		}
+		if repeat, _ := ss.PickServer(key); repeat.String() != addr.String() {
+			t.Fatalf("key %s went to %s, then to %s", key, addr, repeat)
+		}
+		perServer[addr.String()]++
+	}
+
+	if len(perServer) != 3 {
+		t.Fatalf("keys went to %d servers, want 3: %v", len(perServer), perServer)
+	}
+	for addr, n := range perServer {
+		// An even spread is 1000 keys each.
+		if n < keys/3*8/10 || n > keys/3*12/10 {
+			t.Errorf("%s got %d of %d keys, want about %d", addr, n, keys, keys/3)
+		}
+	}
+}
+
+func TestNewServerListEmpty(t *testing.T) {
+	if _, err := newServerList(" , "); err == nil {
+		t.Error("newServerList of no addresses succeeded")
+	}
+}
+
+func TestParseRecordSep(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{`\n`, "\n", true},
+		{`\x1e`, "\x1e", true},
+		{";", ";", true},
+		{"", "", false},
+		{`\x1e\n`, "", false},
+		{`\q`, "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseRecordSep(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRecordSep(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"go_multithreading/loader"
+)
+
+// runPostHook runs command through sh with the loaded file as its argument
+// and the file's results in MEMC_LOAD_* variables. A failing hook is logged
+// but doesn't change the file's status.
+func runPostHook(command, runID string, result *loader.Result) {
+	path := result.DonePath
+	if path == "" {
+		path = result.Name
+	}
+	cmd := exec.Command("sh", "-c", command+` "$@"`, "post-hook", path)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"MEMC_LOAD_RUN_ID="+runID,
+		"MEMC_LOAD_FILE="+result.Name,
+		"MEMC_LOAD_DONE_PATH="+path,
+		"MEMC_LOAD_STATUS="+result.Status,
+		"MEMC_LOAD_LINES="+strconv.Itoa(result.Lines),
+		"MEMC_LOAD_PROCESSED="+strconv.Itoa(result.Processed),
+		"MEMC_LOAD_ERRORS="+strconv.Itoa(result.Errors),
+		"MEMC_LOAD_ERR_RATE="+fmt.Sprint(result.ErrRate),
+		"MEMC_LOAD_ELAPSED_SECONDS="+fmt.Sprint(result.ElapsedSeconds),
+	)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		slog.Error("Post hook failed", "file", result.Name, "exit_code", exitErr.ExitCode())
+	case err != nil:
+		slog.Error("Cannot run post hook", "file", result.Name, "err", err)
+	}
+}
@@ -0,0 +1,48 @@
+package loader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// TextAuthDialer returns a dial function for memcache.Client.DialContext
+// that authenticates every new connection with memcached's text-protocol
+// authentication, as a server started with -Y <authfile> expects. It is not
+// SASL; see SASLDialer for servers started with -S.
+func TextAuthDialer(user, pass string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		nc, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			nc.SetDeadline(deadline)
+		}
+		if err := authenticate(nc, user, pass); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("memcached auth at %s: %v", address, err)
+		}
+		nc.SetDeadline(time.Time{})
+		return nc, nil
+	}
+}
+
+func authenticate(nc net.Conn, user, pass string) error {
+	creds := user + " " + pass
+	if _, err := fmt.Fprintf(nc, "set auth 0 0 %d\r\n%s\r\n", len(creds), creds); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(nc).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != "STORED" {
+		return fmt.Errorf("server replied %q", line)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package loader
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var ErrCircuitOpen = errors.New("circuit open, backend is failing")
+
+// CircuitBreaker stops writes to a backend after a run of consecutive
+// failures. While open, writes fail at once; after the cooldown a single
+// probe write decides whether it closes again or stays open.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	open      bool
+	probing   bool
+}
+
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasProbe := b.probing
+	b.probing = false
+	// Only backend trouble counts; an existing key in add mode or a bad key
+	// says nothing about its health.
+	if err == nil || !isTransient(err) {
+		if b.open {
+			slog.Info("Circuit closed", "backend", b.name)
+		}
+		b.open = false
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if wasProbe || b.failures >= b.threshold {
+		if !b.open {
+			slog.Warn("Circuit opened", "backend", b.name, "failures", b.failures, "cooldown", b.cooldown.String())
+		}
+		b.open = true
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+type breakerSetter struct {
+	Setter
+	breaker *CircuitBreaker
+}
+
+func (s breakerSetter) Set(item *memcache.Item) error {
+	if !s.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	err := s.Setter.Set(item)
+	s.breaker.record(err)
+	return err
+}
+
+func (s breakerSetter) Add(item *memcache.Item) error {
+	if !s.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	err := s.Setter.Add(item)
+	s.breaker.record(err)
+	return err
+}
@@ -0,0 +1,211 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// ErrChunkFailed is returned for a file stopped by a chunk whose error rate
+// reached Options.ErrRate, see Options.ChunkSize.
+var ErrChunkFailed = errors.New("chunk error rate too high")
+
+// checkpoint records how many leading lines of a file are fully written,
+// along with the file's size and mtime so a changed file is not resumed.
+type checkpoint struct {
+	Line  int   `json:"line"`
+	Size  int64 `json:"size"`
+	MTime int64 `json:"mtime"`
+}
+
+// checkpointer advances the checkpoint in steps of every lines. Lines are
+// finished out of order by the workers, so a step is only committed once
+// every line in it and in all the steps before it is done.
+type checkpointer struct {
+	logger *slog.Logger
+	path   string
+	every  int
+	fp     checkpoint
+	start  int
+
+	mu   sync.Mutex
+	next int
+	done map[int]int
+
+	// With checkChunks, attempted and failed count the records of each step
+	// and err is set by the first step over errRate.
+	errRate   float64
+	cancel    context.CancelFunc
+	attempted map[int]int
+	failed    map[int]int
+	err       error
+}
+
+func checkpointPath(filename string) string {
+	return filename + ".checkpoint"
+}
+
+func openCheckpointer(logger *slog.Logger, filename string, info os.FileInfo, every int) *checkpointer {
+	c := &checkpointer{
+		logger: logger,
+		path:   checkpointPath(filename),
+		every:  every,
+		fp:     checkpoint{Size: info.Size(), MTime: info.ModTime().UnixNano()},
+		done:   make(map[int]int),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c
+	}
+	var saved checkpoint
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	switch {
+	case err != nil:
+		logger.Warn("Ignoring unreadable checkpoint", "path", c.path, "err", err)
+	case saved.Size != c.fp.Size || saved.MTime != c.fp.MTime:
+		logger.Warn("File changed since checkpoint, refusing to resume", "path", c.path)
+	default:
+		c.start = saved.Line
+		logger.Info("Resuming from checkpoint", "line", c.start)
+	}
+	return c
+}
+
+func (c *checkpointer) skip() int {
+	if c == nil {
+		return 0
+	}
+	return c.start
+}
+
+// step returns the step, or chunk, line num falls in.
+func (c *checkpointer) step(num int) int {
+	if c == nil {
+		return 0
+	}
+	return (num - c.start) / c.every
+}
+
+// checkChunks treats every step as a chunk with its own error rate. The
+// first chunk reaching errRate stops the file through cancel, and the
+// checkpoint stays before it so a retry starts with that chunk.
+func (c *checkpointer) checkChunks(errRate float64, cancel context.CancelFunc) {
+	if c == nil {
+		return
+	}
+	c.errRate, c.cancel = errRate, cancel
+	c.attempted = make(map[int]int)
+	c.failed = make(map[int]int)
+}
+
+// lineDone marks a record as written, lineFailed as failed and lineSkipped a
+// line without a record, such as a blank or comment line.
+func (c *checkpointer) lineDone(num int) {
+	c.finish(num, true, false)
+}
+
+func (c *checkpointer) lineFailed(num int) {
+	c.finish(num, true, true)
+}
+
+func (c *checkpointer) lineSkipped(num int) {
+	c.finish(num, false, false)
+}
+
+func (c *checkpointer) finish(num int, attempted, failed bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	step := c.step(num)
+	c.done[step]++
+	if c.cancel != nil {
+		if attempted {
+			c.attempted[step]++
+		}
+		if failed {
+			c.failed[step]++
+		}
+	}
+	advanced := false
+	for c.err == nil && c.done[c.next] == c.every && !c.chunkFailed(c.next) {
+		delete(c.done, c.next)
+		delete(c.attempted, c.next)
+		delete(c.failed, c.next)
+		c.next++
+		advanced = true
+	}
+	if advanced {
+		c.save(c.start + c.next*c.every)
+	}
+}
+
+func (c *checkpointer) chunkFailed(step int) bool {
+	if c.cancel == nil {
+		return false
+	}
+	attempted, failed := c.attempted[step], c.failed[step]
+	if attempted == 0 {
+		return false
+	}
+	rate := float64(failed) / float64(attempted)
+	if rate < c.errRate {
+		return false
+	}
+	first := c.start + step*c.every + 1
+	last := first + c.done[step] - 1
+	c.logger.Warn("High error rate in chunk, stopping file", "first_line", first, "last_line", last,
+		"err_rate", rate, "threshold", c.errRate, "attempted", attempted, "errors", failed)
+	c.err = fmt.Errorf("lines %d-%d: error rate %v: %w", first, last, rate, ErrChunkFailed)
+	c.cancel()
+	return true
+}
+
+// chunkErr returns the error of the chunk that stopped the file. Once the
+// whole input is read, final also checks the last, shorter chunk.
+func (c *checkpointer) chunkErr(final bool) error {
+	if c == nil || c.cancel == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil && final && c.done[c.next] > 0 {
+		c.chunkFailed(c.next)
+	}
+	return c.err
+}
+
+func (c *checkpointer) save(line int) {
+	cp := c.fp
+	cp.Line = line
+	data, err := json.Marshal(cp)
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, c.path)
+		}
+	}
+	if err != nil {
+		c.logger.Error("Cannot write checkpoint", "path", c.path, "err", err)
+	}
+}
+
+func (c *checkpointer) remove() error {
+	if c == nil {
+		return nil
+	}
+	err := os.Remove(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func readCheckpoint(t *testing.T, path string) checkpoint {
+	t.Helper()
+	data, err := os.ReadFile(checkpointPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		t.Fatal(err)
+	}
+	return cp
+}
+
+// A chunk over -err-rate stops the file with the checkpoint before it, and
+// a rerun resumes with that chunk. With batches larger than a chunk, each
+// chunk is still written before the next one starts.
+func TestProcessFileResumeAfterFailedChunk(t *testing.T) {
+	const chunk = 10
+	lines := fixtureLines(4*chunk, 0)
+	path := writeGzip(t, "chunks.tsv.gz", lines...)
+	// The third chunk's keys, dev20 to dev29, fail.
+	failing := make(map[string]bool)
+	for i := 2 * chunk; i < 3*chunk; i++ {
+		record, _ := ParseAppsInstalled(lines[i], ParseOptions{})
+		failing[record.DevType+":"+record.DevID] = true
+	}
+	options := func(sink *fakeSetter) Options {
+		opts := testOptions(sink)
+		opts.Workers = 1
+		opts.BatchSize = 100
+		opts.ChunkSize = chunk
+		opts.CheckpointEvery = chunk
+		opts.ErrRate = 0.5
+		return opts
+	}
+
+	sink := newFakeSetter()
+	sink.fail = func(key string, call int) error {
+		if failing[key] {
+			return fmt.Errorf("write %s failed", key)
+		}
+		return nil
+	}
+	result, err := ProcessFile(context.Background(), path, testClients, options(sink))
+	if !errors.Is(err, ErrChunkFailed) {
+		t.Fatalf("err = %v, want ErrChunkFailed", err)
+	}
+	if cp := readCheckpoint(t, path); cp.Line != 2*chunk {
+		t.Errorf("checkpoint at line %d, want %d", cp.Line, 2*chunk)
+	}
+	if result.DonePath != "" {
+		t.Errorf("file with a failed chunk marked done as %q", result.DonePath)
+	}
+	// Only the first line of the last chunk was batched when the third one
+	// failed.
+	if got := sink.len(); got > 2*chunk+1 {
+		t.Errorf("%d keys written, want the first two chunks and at most one more line", got)
+	}
+
+	rerun := newFakeSetter()
+	result, err = ProcessFile(context.Background(), path, testClients, options(rerun))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != StatusOK || result.Processed != 2*chunk || result.DonePath == "" {
+		t.Errorf("rerun: status %s, processed %d, done path %q; want ok, %d and done",
+			result.Status, result.Processed, result.DonePath, 2*chunk)
+	}
+	for i, line := range lines {
+		record, _ := ParseAppsInstalled(line, ParseOptions{})
+		if _, ok := rerun.value(record.DevType + ":" + record.DevID); ok != (i >= 2*chunk) {
+			t.Errorf("rerun: line %d written = %v, want %v", i+1, ok, i >= 2*chunk)
+		}
+	}
+	if _, err := os.Stat(checkpointPath(path)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left after the rerun: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package loader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+const DefaultCompressThreshold = 1024
+
+// With -compress-values every stored value starts with one of these bytes.
+const (
+	valueRaw  byte = 0
+	valueGzip byte = 1
+)
+
+// encodeValue adds the header byte and gzips payloads of at least threshold
+// bytes; smaller ones are stored as is since gzip overhead outweighs the gain.
+func encodeValue(data []byte, threshold int) ([]byte, error) {
+	if len(data) < threshold {
+		return append([]byte{valueRaw}, data...), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(valueGzip)
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeValue returns the serialized UserApps from a value written with
+// -compress-values.
+func DecodeValue(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	switch value[0] {
+	case valueRaw:
+		return value[1:], nil
+	case valueGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(value[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return io.ReadAll(gz)
+	}
+	return nil, fmt.Errorf("unknown value header %#x", value[0])
+}
+
+func encodeRecord(apps AppsInstalled, opts Options) ([]byte, error) {
+	var serializer Serializer = ProtobufSerializer{}
+	if opts.Serializer != nil {
+		serializer = opts.Serializer
+	}
+	data, err := serializer.Serialize(apps)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CompressValues {
+		if data, err = encodeValue(data, opts.CompressThreshold); err != nil {
+			return nil, err
+		}
+	}
+	if opts.WithHeader || opts.CAS {
+		data = addHeader(data, serializer, opts.CompressValues)
+	}
+	return data, nil
+}
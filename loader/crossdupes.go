@@ -0,0 +1,66 @@
+package loader
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// KeyTracker spots keys that show up in more than one input of a run, which
+// usually means the upstream exports overlap. It holds every unique key of
+// the run in memory, so memory grows with the number of distinct keys (about
+// the key length plus a few dozen bytes of map overhead each).
+type KeyTracker struct {
+	mu    sync.Mutex
+	first map[string]string
+	dupes map[filePair]int
+}
+
+type filePair struct {
+	first, second string
+}
+
+func NewKeyTracker() *KeyTracker {
+	return &KeyTracker{
+		first: make(map[string]string),
+		dupes: make(map[filePair]int),
+	}
+}
+
+func (t *KeyTracker) add(name, key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	first, ok := t.first[key]
+	if !ok {
+		t.first[key] = name
+		return
+	}
+	if first != name {
+		t.dupes[filePair{first, name}]++
+	}
+}
+
+// Report logs a warning for every pair of inputs that share keys.
+func (t *KeyTracker) Report() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pairs := make([]filePair, 0, len(t.dupes))
+	total := 0
+	for pair, n := range t.dupes {
+		pairs = append(pairs, pair)
+		total += n
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].first != pairs[j].first {
+			return pairs[i].first < pairs[j].first
+		}
+		return pairs[i].second < pairs[j].second
+	})
+	for _, pair := range pairs {
+		slog.Warn("Keys repeated across files", "first", pair.first, "again_in", pair.second, "keys", t.dupes[pair])
+	}
+	slog.Info("Cross-file duplicates", "unique_keys", len(t.first), "duplicates", total)
+}
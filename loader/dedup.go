@@ -0,0 +1,50 @@
+package loader
+
+import (
+	"slices"
+	"sync"
+)
+
+// dedupMap keeps the last occurrence of every key seen in a file. It holds
+// one parsed record per unique key until the file has been read, so memory
+// grows with the number of distinct keys in the file.
+type dedupMap struct {
+	mu      sync.Mutex
+	entries map[string]dedupEntry
+	dropped int
+}
+
+type dedupEntry struct {
+	num  int
+	apps *AppsInstalled
+	line string
+}
+
+func newDedupMap() *dedupMap {
+	return &dedupMap{entries: make(map[string]dedupEntry)}
+}
+
+func (d *dedupMap) put(key string, num int, apps *AppsInstalled, line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prev, ok := d.entries[key]
+	if ok {
+		d.dropped++
+		if prev.num > num {
+			return
+		}
+	}
+	d.entries[key] = dedupEntry{num: num, apps: apps, line: line}
+}
+
+// ordered returns the entries in input order of the records kept.
+func (d *dedupMap) ordered() []dedupEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := make([]dedupEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b dedupEntry) int { return a.num - b.num })
+	return entries
+}
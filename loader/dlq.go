@@ -0,0 +1,79 @@
+package loader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// DeadLetterQueue appends failed input lines to a gzipped file, each preceded
+// by a "# reason" comment line. Comment lines are skipped on input, so the
+// file can be fed back to the loader as is.
+type DeadLetterQueue struct {
+	records chan deadLetter
+	done    chan struct{}
+	file    *os.File
+	gz      *gzip.Writer
+	err     error
+}
+
+type deadLetter struct {
+	reason string
+	line   string
+}
+
+// OpenDeadLetterQueue opens path for appending, gzipping at level, from
+// gzip.NoCompression to gzip.BestCompression or gzip.DefaultCompression.
+func OpenDeadLetterQueue(path string, level int) (*DeadLetterQueue, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewWriterLevel(file, level)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	q := &DeadLetterQueue{
+		records: make(chan deadLetter, 1024),
+		done:    make(chan struct{}),
+		file:    file,
+		gz:      gz,
+	}
+	go q.run()
+	return q, nil
+}
+
+func (q *DeadLetterQueue) run() {
+	defer close(q.done)
+	for rec := range q.records {
+		if q.err != nil {
+			continue
+		}
+		if _, err := fmt.Fprintf(q.gz, "# %s\n%s\n", rec.reason, rec.line); err != nil {
+			q.err = err
+			slog.Error("Cannot write to dead-letter file", "path", q.file.Name(), "err", err)
+		}
+	}
+}
+
+func (q *DeadLetterQueue) add(reason, line string) {
+	if q == nil {
+		return
+	}
+	q.records <- deadLetter{reason: reason, line: line}
+}
+
+func (q *DeadLetterQueue) Close() error {
+	close(q.records)
+	<-q.done
+	err := q.err
+	if cerr := q.gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := q.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// What happens to an input once it has loaded: rename marks it with a
+// leading dot, none leaves it alone and move:<dir> puts it into dir.
+const (
+	DoneRename     = "rename"
+	DoneNone       = "none"
+	doneMovePrefix = "move:"
+)
+
+func ValidateDoneAction(action string) error {
+	switch {
+	case action == DoneRename || action == DoneNone:
+		return nil
+	case strings.HasPrefix(action, doneMovePrefix):
+		dir := strings.TrimPrefix(action, doneMovePrefix)
+		if dir == "" {
+			return fmt.Errorf("move needs a directory, e.g. move:/data/done")
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action %q, want rename, none or move:<dir>", action)
+}
+
+// finishFile applies action to a loaded file and returns its new path.
+func finishFile(path, action string) (string, error) {
+	switch {
+	case action == DoneNone:
+		return path, nil
+	case strings.HasPrefix(action, doneMovePrefix):
+		dst := filepath.Join(strings.TrimPrefix(action, doneMovePrefix), filepath.Base(path))
+		return dst, moveFile(path, dst)
+	}
+	dir, file := filepath.Split(path)
+	dst := filepath.Join(dir, "."+file)
+	return dst, os.Rename(path, dst)
+}
+
+// moveFile falls back to copy and delete when dst is on another device.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
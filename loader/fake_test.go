@@ -0,0 +1,152 @@
+package loader
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// fakeSetter is an in-memory memcached for the write path. It is a Setter
+// and, through Write, a Sink, so whole files can be loaded into it with
+// Options.Sink. fail, if set, is asked before every write and its error is
+// returned instead of storing the item.
+type fakeSetter struct {
+	mu     sync.Mutex
+	fail   func(key string, call int) error
+	calls  int
+	items  map[string][]byte
+	writes []string
+}
+
+func newFakeSetter() *fakeSetter {
+	return &fakeSetter{items: make(map[string][]byte)}
+}
+
+func (f *fakeSetter) store(key string, value []byte, add bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.fail != nil {
+		if err := f.fail(key, f.calls); err != nil {
+			return err
+		}
+	}
+	if _, ok := f.items[key]; ok && add {
+		return memcache.ErrNotStored
+	}
+	f.items[key] = value
+	f.writes = append(f.writes, key)
+	return nil
+}
+
+func (f *fakeSetter) Set(item *memcache.Item) error {
+	return f.store(item.Key, item.Value, false)
+}
+
+func (f *fakeSetter) Add(item *memcache.Item) error {
+	return f.store(item.Key, item.Value, true)
+}
+
+func (f *fakeSetter) Write(devType string, item *memcache.Item) error {
+	return f.store(item.Key, item.Value, false)
+}
+
+func (f *fakeSetter) value(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.items[key]
+	return value, ok
+}
+
+func (f *fakeSetter) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.items)
+}
+
+func (f *fakeSetter) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// fakeCAS is an in-memory memcached for casSetter. Every stored value has a
+// version, and the item Get returns remembers the one it saw: CompareAndSwap
+// fails with ErrCASConflict when the key has changed since.
+type fakeCAS struct {
+	mu        sync.Mutex
+	items     map[string]*casEntry
+	seen      map[*memcache.Item]int
+	conflicts int
+}
+
+type casEntry struct {
+	value   []byte
+	version int
+}
+
+func newFakeCAS() *fakeCAS {
+	return &fakeCAS{items: make(map[string]*casEntry), seen: make(map[*memcache.Item]int)}
+}
+
+func (f *fakeCAS) Get(key string) (*memcache.Item, error) {
+	f.mu.Lock()
+	entry, ok := f.items[key]
+	var item *memcache.Item
+	if ok {
+		item = &memcache.Item{Key: key, Value: entry.value}
+		f.seen[item] = entry.version
+	}
+	f.mu.Unlock()
+	// Let other writers in between the read and the swap.
+	runtime.Gosched()
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	return item, nil
+}
+
+func (f *fakeCAS) CompareAndSwap(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	version, ok := f.seen[item]
+	if !ok {
+		panic("CompareAndSwap of an item not returned by Get")
+	}
+	delete(f.seen, item)
+	entry, ok := f.items[item.Key]
+	if !ok {
+		return memcache.ErrCacheMiss
+	}
+	if entry.version != version {
+		f.conflicts++
+		return memcache.ErrCASConflict
+	}
+	entry.value = item.Value
+	entry.version++
+	return nil
+}
+
+func (f *fakeCAS) Set(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entry, ok := f.items[item.Key]
+	if !ok {
+		f.items[item.Key] = &casEntry{value: item.Value}
+		return nil
+	}
+	entry.value = item.Value
+	entry.version++
+	return nil
+}
+
+func (f *fakeCAS) Add(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	f.items[item.Key] = &casEntry{value: item.Value}
+	return nil
+}
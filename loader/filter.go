@@ -0,0 +1,14 @@
+package loader
+
+// Fields Options.Filter can match.
+const (
+	FilterDevID   = "dev_id"
+	FilterDevType = "dev_type"
+)
+
+func filterValue(apps *AppsInstalled, field string) string {
+	if field == FilterDevType {
+		return apps.DevType
+	}
+	return apps.DevID
+}
@@ -0,0 +1,122 @@
+package loader
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// HeaderVersion is the schema version written by -with-header.
+const HeaderVersion byte = 1
+
+// HeaderVersionOrdered is the version written with -cas, whose header goes
+// on with the record's WriteOrder after the format byte.
+const HeaderVersionOrdered byte = 2
+
+const orderLen = 16
+
+// The second header byte holds the format; its high bit marks a payload
+// encoded with -compress-values.
+const (
+	formatProtobuf   byte = 0
+	formatJSON       byte = 1
+	formatOther      byte = 0x7f
+	formatCompressed byte = 0x80
+)
+
+// ValueHeader describes a value written with -with-header.
+type ValueHeader struct {
+	Version    byte
+	Format     string
+	Compressed bool
+	// Order is set for HeaderVersionOrdered.
+	Order WriteOrder
+}
+
+// WriteOrder orders the records of a key written with -cas: by the epoch of
+// the file they came from, the time its load started, then by line number.
+type WriteOrder struct {
+	Epoch int64
+	Line  uint64
+}
+
+func (o WriteOrder) Before(other WriteOrder) bool {
+	if o.Epoch != other.Epoch {
+		return o.Epoch < other.Epoch
+	}
+	return o.Line < other.Line
+}
+
+func formatID(s Serializer) byte {
+	switch s.(type) {
+	case nil, ProtobufSerializer:
+		return formatProtobuf
+	case JSONSerializer:
+		return formatJSON
+	}
+	return formatOther
+}
+
+func addHeader(data []byte, serializer Serializer, compressed bool) []byte {
+	format := formatID(serializer)
+	if compressed {
+		format |= formatCompressed
+	}
+	return append([]byte{HeaderVersion, format}, data...)
+}
+
+// withOrder turns the HeaderVersion header of value into a
+// HeaderVersionOrdered one carrying order.
+func withOrder(value []byte, order WriteOrder) []byte {
+	ordered := make([]byte, 2+orderLen, len(value)+orderLen)
+	ordered[0] = HeaderVersionOrdered
+	ordered[1] = value[1]
+	binary.BigEndian.PutUint64(ordered[2:], uint64(order.Epoch))
+	binary.BigEndian.PutUint64(ordered[10:], order.Line)
+	return append(ordered, value[2:]...)
+}
+
+// valueOrder returns the WriteOrder of a value written with -cas. Values
+// without one, written before or without -cas, come before any that has.
+func valueOrder(value []byte) WriteOrder {
+	if len(value) < 2+orderLen || value[0] != HeaderVersionOrdered {
+		return WriteOrder{}
+	}
+	return WriteOrder{
+		Epoch: int64(binary.BigEndian.Uint64(value[2:])),
+		Line:  binary.BigEndian.Uint64(value[10:]),
+	}
+}
+
+// DecodeHeader reads the header of a value written with -with-header and
+// returns the serialized record, decompressed if needed.
+func DecodeHeader(value []byte) (ValueHeader, []byte, error) {
+	if len(value) < 2 {
+		return ValueHeader{}, nil, fmt.Errorf("value too short for a header: %d bytes", len(value))
+	}
+	header := ValueHeader{Version: value[0], Compressed: value[1]&formatCompressed != 0}
+	payload := value[2:]
+	switch header.Version {
+	case HeaderVersion:
+	case HeaderVersionOrdered:
+		if len(value) < 2+orderLen {
+			return header, nil, fmt.Errorf("value too short for an ordered header: %d bytes", len(value))
+		}
+		header.Order = valueOrder(value)
+		payload = value[2+orderLen:]
+	default:
+		return header, nil, fmt.Errorf("unsupported value version %d", header.Version)
+	}
+	switch value[1] &^ formatCompressed {
+	case formatProtobuf:
+		header.Format = "protobuf"
+	case formatJSON:
+		header.Format = "json"
+	default:
+		header.Format = "other"
+	}
+	if !header.Compressed {
+		return header, payload, nil
+	}
+	payload, err := DecodeValue(payload)
+	return header, payload, err
+}
@@ -0,0 +1,87 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const healthCheckKey = "memc_load:healthcheck"
+
+func checkBackend(mc *memcache.Client) error {
+	if err := mc.Ping(); err != nil {
+		return fmt.Errorf("ping: %v", err)
+	}
+	item := &memcache.Item{Key: healthCheckKey, Value: []byte("ok"), Expiration: 60}
+	if err := mc.Set(item); err != nil {
+		return fmt.Errorf("set: %v", err)
+	}
+	if _, err := mc.Get(healthCheckKey); err != nil {
+		return fmt.Errorf("get: %v", err)
+	}
+	if err := mc.Delete(healthCheckKey); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		return fmt.Errorf("delete: %v", err)
+	}
+	return nil
+}
+
+func HealthCheck(mcClients map[string]*memcache.Client) error {
+	devTypes := make([]string, 0, len(mcClients))
+	for devType := range mcClients {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+
+	var failed []string
+	for _, devType := range devTypes {
+		if err := checkBackend(mcClients[devType]); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", devType, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unreachable memcached backends: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Preconnect fills the idle pool of every client with up to conns verified
+// connections per server. gomemcache dials lazily, so otherwise the first
+// writes of every worker pay for connection setup. Concurrent pings each
+// hold their own connection, which all go back to the pool.
+func Preconnect(mcClients map[string]*memcache.Client, conns int) error {
+	devTypes := make([]string, 0, len(mcClients))
+	for devType := range mcClients {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+
+	var failed []string
+	for _, devType := range devTypes {
+		mc := mcClients[devType]
+		errs := make(chan error, conns)
+		var wg sync.WaitGroup
+		for i := 0; i < conns; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- mc.Ping()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s (%v)", devType, err))
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot preconnect to memcached backends: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+//go:build integration
+
+package loader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"go_multithreading/appsinstalled"
+	"google.golang.org/protobuf/proto"
+)
+
+// integrationClients returns clients of the memcached at MEMCACHED_ADDR for
+// every device type of the fixtures, or skips the test if it is not set:
+//
+//	MEMCACHED_ADDR=127.0.0.1:11211 go test -tags integration ./loader
+func integrationClients(t *testing.T) (*memcache.Client, map[string]*memcache.Client) {
+	t.Helper()
+	addr := os.Getenv("MEMCACHED_ADDR")
+	if addr == "" {
+		t.Skip("MEMCACHED_ADDR is not set")
+	}
+	mc := memcache.New(addr)
+	if err := mc.Ping(); err != nil {
+		t.Fatalf("memcached at %s: %v", addr, err)
+	}
+	clients := make(map[string]*memcache.Client, len(testClients))
+	for devType := range testClients {
+		clients[devType] = mc
+	}
+	return mc, clients
+}
+
+// uniqueLines returns good records of every device type whose dev ids are
+// unique to this run, so earlier runs against the same server don't matter.
+func uniqueLines(n int) []string {
+	run := time.Now().UnixNano()
+	devTypes := []string{"idfa", "gaid", "adid", "dvid"}
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%s\tit%d-%d\t%d.5\t-%d.25\t%d,%d", devTypes[i%len(devTypes)], run, i, i%90, i%180, i, i+1)
+	}
+	return lines
+}
+
+// getApps reads key back and decodes its protobuf value.
+func getApps(t *testing.T, mc *memcache.Client, key string) *appsinstalled.UserApps {
+	t.Helper()
+	item, err := mc.Get(key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	var ua appsinstalled.UserApps
+	if err := proto.Unmarshal(item.Value, &ua); err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	return &ua
+}
+
+func TestIntegrationProcessFile(t *testing.T) {
+	mc, clients := integrationClients(t)
+	lines := uniqueLines(200)
+	for _, batch := range []int{1, 16} {
+		t.Run(fmt.Sprintf("batch=%d", batch), func(t *testing.T) {
+			path := writeGzip(t, "it.tsv.gz", lines...)
+			opts := testOptions(nil)
+			opts.BatchSize = batch
+			opts.BatchConcurrency = 4
+			result, err := ProcessFile(context.Background(), path, clients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != StatusOK || result.Processed != len(lines) || result.Errors != 0 {
+				t.Fatalf("status %s, processed %d, errors %d; want ok, %d, 0",
+					result.Status, result.Processed, result.Errors, len(lines))
+			}
+			for _, line := range lines {
+				want, err := ParseAppsInstalled(line, ParseOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := getApps(t, mc, want.DevType+":"+want.DevID)
+				if got.GetLat() != want.Lat || got.GetLon() != want.Lon || !slices.Equal(got.GetApps(), want.Apps) {
+					t.Errorf("%s:%s = %v, want %+v", want.DevType, want.DevID, got, *want)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegrationMerge(t *testing.T) {
+	mc, clients := integrationClients(t)
+	key := fmt.Sprintf("idfa:merge%d", time.Now().UnixNano())
+	devID := key[len("idfa:"):]
+	// Every file adds its own app ids to the same key.
+	for i := range 3 {
+		path := writeGzip(t, "merge.tsv.gz", fmt.Sprintf("idfa\t%s\t1\t2\t%d,%d", devID, 2*i, 2*i+1))
+		opts := testOptions(nil)
+		opts.Mode = ModeMerge
+		if result, err := ProcessFile(context.Background(), path, clients, opts); err != nil || result.Processed != 1 {
+			t.Fatalf("file %d: processed %d, %v", i, result.Processed, err)
+		}
+	}
+	got := getApps(t, mc, key)
+	apps := slices.Clone(got.GetApps())
+	slices.Sort(apps)
+	if want := []uint32{0, 1, 2, 3, 4, 5}; !slices.Equal(apps, want) {
+		t.Errorf("%s apps %v, want %v", key, apps, want)
+	}
+}
+
+func TestIntegrationAdd(t *testing.T) {
+	mc, clients := integrationClients(t)
+	lines := uniqueLines(8)
+	path := writeGzip(t, "add.tsv.gz", lines...)
+	if _, err := ProcessFile(context.Background(), path, clients, testOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+	// The same keys with other apps are kept as first written.
+	changed := make([]string, len(lines))
+	for i, line := range lines {
+		changed[i] = line + ",999"
+	}
+	path = writeGzip(t, "add.tsv.gz", changed...)
+	opts := testOptions(nil)
+	opts.Mode = ModeAdd
+	result, err := ProcessFile(context.Background(), path, clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != 0 || result.Stats.SkippedExisting != len(lines) {
+		t.Errorf("processed %d, skipped existing %d; want 0 and %d", result.Processed, result.Stats.SkippedExisting, len(lines))
+	}
+	for _, line := range lines {
+		want, _ := ParseAppsInstalled(line, ParseOptions{})
+		if got := getApps(t, mc, want.DevType+":"+want.DevID); !slices.Equal(got.GetApps(), want.Apps) {
+			t.Errorf("%s:%s apps %v, want %v", want.DevType, want.DevID, got.GetApps(), want.Apps)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package loader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const DefaultKeyTemplate = "{{.DevType}}:{{.DevID}}"
+
+type keyFields struct {
+	DevType string
+	DevID   string
+}
+
+// ParseKeyTemplate parses a memcached key template. Field references are
+// only resolved on execution, so the template is run once against a sample
+// record to reject unknown fields up front.
+func ParseKeyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("key").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := executeKey(tmpl, keyFields{DevType: "idfa", DevID: "sample"}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func executeKey(tmpl *template.Template, fields keyFields) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", err
+	}
+	if b.Len() == 0 {
+		return "", errors.New("key template produced an empty key")
+	}
+	return b.String(), nil
+}
+
+// maxKeyLen is the memcached limit on key length.
+const maxKeyLen = 250
+
+// ValidateKeyPrefix checks that prefix can start a memcached key: it must be
+// non-empty, shorter than a key and free of spaces and control characters.
+func ValidateKeyPrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("empty key prefix")
+	}
+	if len(prefix) >= maxKeyLen {
+		return fmt.Errorf("key prefix is %d bytes, want less than %d", len(prefix), maxKeyLen)
+	}
+	for i := 0; i < len(prefix); i++ {
+		if prefix[i] <= ' ' || prefix[i] == 0x7f {
+			return fmt.Errorf("key prefix %q contains a space or control character", prefix)
+		}
+	}
+	return nil
+}
+
+func itemKey(apps AppsInstalled, opts Options) (string, error) {
+	var key string
+	if opts.KeyTemplate == nil {
+		key = apps.DevType + ":" + apps.DevID
+	} else {
+		var err error
+		key, err = executeKey(opts.KeyTemplate, keyFields{DevType: apps.DevType, DevID: apps.DevID})
+		if err != nil {
+			return "", err
+		}
+	}
+	return opts.KeyPrefixes[apps.DevType] + key, nil
+}
+
+// KeyPrinter writes the key of every record of a dry run, and with sizes the
+// length of its value, one per line. Workers share it, so lines are only in
+// input order with a single worker.
+type KeyPrinter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	sizes bool
+}
+
+func NewKeyPrinter(w io.Writer, sizes bool) *KeyPrinter {
+	return &KeyPrinter{w: bufio.NewWriter(w), sizes: sizes}
+}
+
+func (p *KeyPrinter) print(key string, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sizes {
+		fmt.Fprintf(p.w, "%s\t%d\n", key, size)
+	} else {
+		fmt.Fprintln(p.w, key)
+	}
+}
+
+func (p *KeyPrinter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.w.Flush()
+}
@@ -0,0 +1,48 @@
+package loader
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// NumLatencyBuckets is the size of the set latency histogram: one bucket per
+// bound in latencyBounds plus one for slower calls.
+const NumLatencyBuckets = 5
+
+var latencyBounds = [NumLatencyBuckets - 1]time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+}
+
+// LatencyBucketNames label the buckets of TypeStats.SetLatency.
+var LatencyBucketNames = [NumLatencyBuckets]string{"lt_1ms", "lt_5ms", "lt_10ms", "lt_50ms", "ge_50ms"}
+
+func latencyBucket(d time.Duration) int {
+	for i, bound := range latencyBounds {
+		if d < bound {
+			return i
+		}
+	}
+	return NumLatencyBuckets - 1
+}
+
+// timedSetter measures every call to memcached, retries included.
+type timedSetter struct {
+	Setter
+	devType string
+	stats   *Stats
+}
+
+func (s timedSetter) Set(item *memcache.Item) error {
+	start := time.Now()
+	err := s.Setter.Set(item)
+	s.stats.addLatency(s.devType, time.Since(start))
+	return err
+}
+
+func (s timedSetter) Add(item *memcache.Item) error {
+	start := time.Now()
+	err := s.Setter.Add(item)
+	s.stats.addLatency(s.devType, time.Since(start))
+	return err
+}
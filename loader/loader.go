@@ -0,0 +1,269 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultErrRate = 0.01
+	retryBaseDelay = 50 * time.Millisecond
+)
+
+const (
+	ModeSet = "set"
+	ModeAdd = "add"
+	// ModeMerge adds the record's app ids to those already stored under
+	// its key, see newMergeSetter.
+	ModeMerge = "merge"
+)
+
+// Setter is the part of *memcache.Client the write path needs, so a fake can
+// stand in for a real server.
+type Setter interface {
+	Set(item *memcache.Item) error
+	Add(item *memcache.Item) error
+}
+
+type Options struct {
+	Parse     ParseOptions
+	ErrRate   float64
+	DryRun    bool
+	ParseOnly bool
+	DrySample int
+	Dedup     bool
+	Workers   int
+	Buffer    int
+	MaxLine   int
+	// LowMem reads gzip input with fewer and smaller read-ahead blocks.
+	LowMem bool
+	// RecordSep is the single byte ending a record; empty means newline.
+	RecordSep string
+	// Limit stops reading an input after this many lines; a cut short file
+	// is not marked done.
+	Limit int
+	// WarnEmpty sets StatusEmpty on inputs without records and leaves them
+	// in place instead of treating them as loaded. Blank, comment and header
+	// lines are not records.
+	WarnEmpty bool
+	BatchSize int
+	Retries   int
+	TTL       int32
+	DLQ       *DeadLetterQueue
+	// KeyPrinter, if set, gets the key of every record of a dry run.
+	KeyPrinter *KeyPrinter
+	Limiter    *rate.Limiter
+
+	CrossDupes *KeyTracker
+	Sink       Sink
+	Breakers   map[string]*CircuitBreaker
+
+	CheckpointEvery    int
+	ProgressInterval   time.Duration
+	BatchFlushInterval time.Duration
+	BatchConcurrency   int
+	KeyTemplate        *template.Template
+	// KeyPrefixes maps a device type to a prefix prepended to the key the
+	// template builds.
+	KeyPrefixes map[string]string
+
+	Mode              string
+	DoneAction        string
+	Serializer        Serializer
+	CompressValues    bool
+	CompressThreshold int
+	WithHeader        bool
+	VerifyRate        float64
+	// VerifyOnly reads every record back and compares it instead of
+	// writing it.
+	VerifyOnly bool
+	// Diff reads every record's stored value and counts it as new, changed
+	// or unchanged instead of writing it.
+	Diff bool
+	// PartitionByType hands every device type to its own share of Workers
+	// writers; the workers reading the input then only parse.
+	PartitionByType bool
+	// CAS writes in set mode with gets and CompareAndSwap and keeps the
+	// stored value if it is a later record, see newOrderedSetter. Values
+	// then have a header, as with WithHeader, carrying their WriteOrder:
+	// CASEpoch, set when a file starts loading unless given, and the line.
+	CAS      bool
+	CASEpoch int64
+	// SampleRate, if in (0, 1), keeps only that share of the lines, chosen
+	// by SampleSeed and the line number.
+	SampleRate float64
+	SampleSeed uint64
+	// TruncateOversize retries records memcached rejected as too large with
+	// only as many apps as should fit.
+	TruncateOversize bool
+	// ChunkSize, if set, commits the checkpoint in chunks of that many lines
+	// and fails the file at the first chunk whose own error rate reaches
+	// ErrRate, leaving the checkpoint before it. Open batches are flushed
+	// whenever a worker moves on to the next chunk.
+	ChunkSize int
+	// Filter, if set, skips records whose FilterField, FilterDevID unless
+	// set, doesn't match; they are neither processed nor errors.
+	Filter      *regexp.Regexp
+	FilterField string
+	// TopSizes is how many of the largest serialized records to keep with
+	// their keys, see Stats.Largest.
+	TopSizes int
+}
+
+type AppsInstalled struct {
+	DevType string
+	DevID   string
+	Lat     float64
+	Lon     float64
+	Apps    []uint32
+}
+
+func SerializeAppsInstalled(apps AppsInstalled) ([]byte, error) {
+	return marshalApps(apps)
+}
+
+func newItem(apps AppsInstalled, opts Options) (*memcache.Item, error) {
+	key, err := itemKey(apps, opts)
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeRecord(apps, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &memcache.Item{
+		Key:        key,
+		Value:      data,
+		Expiration: opts.TTL,
+	}, nil
+}
+
+// gomemcache declares memcache.ErrServerError but reports SERVER_ERROR
+// replies, such as running out of memory, only as an unexpected response
+// line, so those are matched by their text. An item too large for memcached
+// is a SERVER_ERROR too but fails the same way every time.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if msg := err.Error(); strings.Contains(msg, "SERVER_ERROR") && !strings.Contains(msg, "object too large") {
+		return true
+	}
+	if errors.Is(err, memcache.ErrServerError) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var cte *memcache.ConnectTimeoutError
+	if errors.As(err, &cte) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func limitedSet(ctx context.Context, mc Setter, item *memcache.Item, opts Options) error {
+	if opts.Limiter != nil {
+		if err := opts.Limiter.Wait(ctx); err != nil {
+			// Wait fails early if the wait would pass the deadline.
+			if ctx.Err() == nil {
+				err = fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
+			}
+			return err
+		}
+	}
+	if opts.Mode == ModeAdd {
+		return tooLargeError(mc.Add(item))
+	}
+	return tooLargeError(mc.Set(item))
+}
+
+func setWithRetry(ctx context.Context, mc Setter, item *memcache.Item, opts Options) error {
+	delay := retryBaseDelay
+	err := limitedSet(ctx, mc, item, opts)
+	for attempt := 0; attempt < opts.Retries && isTransient(err); attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		err = limitedSet(ctx, mc, item, opts)
+	}
+	return err
+}
+
+// InsertAppsInstalled writes one record. In add mode an existing key yields
+// memcache.ErrNotStored, which is returned without being logged as a failure.
+func InsertAppsInstalled(ctx context.Context, logger *slog.Logger, mc Setter, apps AppsInstalled, opts Options) error {
+	if opts.DryRun {
+		logger.Info("Dry run - would insert", "record", fmt.Sprintf("%+v", apps))
+		return nil
+	}
+
+	item, err := newItem(apps, opts)
+	if err != nil {
+		logger.Error("Serialization error", "err", err)
+		return err
+	}
+	return insertItem(ctx, logger, mc, item, opts)
+}
+
+func insertItem(ctx context.Context, logger *slog.Logger, mc Setter, item *memcache.Item, opts Options) error {
+	err := setWithRetry(ctx, mc, item, opts)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, memcache.ErrNotStored) && !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, ErrItemTooLarge) {
+		logger.Error("Cannot write to memcached", "key", item.Key, "err", err)
+	}
+	return err
+}
+
+// gomemcache has no multi-set or pipelining, so a batch is written with up
+// to opts.BatchConcurrency items in flight at once, each on its own pooled
+// connection, which cuts the round trips the batch waits for by that factor.
+// The returned errors are per item: memcache.ErrNotStored for keys skipped in
+// add mode, ErrItemTooLarge for items memcached rejected for their size and
+// ctx's error for items not attempted once it is done.
+func flushBatch(ctx context.Context, mc Setter, items []*memcache.Item, opts Options) []error {
+	errs := make([]error, len(items))
+	var next atomic.Int64
+	var panicked atomic.Pointer[any]
+	var wg sync.WaitGroup
+	for range min(max(opts.BatchConcurrency, 1), len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A panic is raised again in the caller, where the worker's guard
+			// recovers it.
+			defer func() {
+				if r := recover(); r != nil {
+					panicked.CompareAndSwap(nil, &r)
+				}
+			}()
+			for i := int(next.Add(1) - 1); i < len(items); i = int(next.Add(1) - 1) {
+				if err := ctx.Err(); err != nil {
+					errs[i] = err
+					continue
+				}
+				errs[i] = setWithRetry(ctx, mc, items[i], opts)
+			}
+		}()
+	}
+	wg.Wait()
+	if r := panicked.Load(); r != nil {
+		panic(*r)
+	}
+	return errs
+}
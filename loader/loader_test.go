@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// serverError is how gomemcache reports a SERVER_ERROR reply to a set.
+func serverError(reply string) error {
+	return fmt.Errorf("memcache: unexpected response line from %q: %q", "set", reply+"\r\n")
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"server error reply", serverError("SERVER_ERROR out of memory storing object"), true},
+		{"object too large", serverError("SERVER_ERROR object too large for cache"), false},
+		{"object too large wrapped", tooLargeError(serverError("SERVER_ERROR object too large for cache")), false},
+		{"ErrServerError", memcache.ErrServerError, true},
+		{"connection refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"connect timeout", &memcache.ConnectTimeoutError{Addr: &net.TCPAddr{}}, true},
+		{"not stored", memcache.ErrNotStored, false},
+		{"malformed key", memcache.ErrMalformedKey, false},
+		{"other reply", serverError("CLIENT_ERROR bad data chunk"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failCalls int
+		failErr   error
+		want      error
+		calls     int
+		stored    bool
+	}{
+		{"success", 0, nil, nil, 1, true},
+		{"server error retried", 2, serverError("SERVER_ERROR out of memory storing object"), nil, 3, true},
+		{"server error exhausts retries", 10, serverError("SERVER_ERROR out of memory storing object"), nil, 4, false},
+		{"too large not retried", 10, serverError("SERVER_ERROR object too large for cache"), ErrItemTooLarge, 1, false},
+		{"permanent error not retried", 10, memcache.ErrMalformedKey, memcache.ErrMalformedKey, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := newFakeSetter()
+			mc.fail = func(key string, call int) error {
+				if call <= tt.failCalls {
+					return tt.failErr
+				}
+				return nil
+			}
+			item := &memcache.Item{Key: "idfa:1", Value: []byte("v")}
+			err := setWithRetry(context.Background(), mc, item, Options{Retries: 3})
+			switch {
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("err = %v, want %v", err, tt.want)
+			case tt.want == nil && tt.stored && err != nil:
+				t.Errorf("err = %v, want nil", err)
+			case !tt.stored && err == nil:
+				t.Errorf("err = nil, want an error")
+			}
+			if got := mc.callCount(); got != tt.calls {
+				t.Errorf("calls = %d, want %d", got, tt.calls)
+			}
+			if _, ok := mc.value(item.Key); ok != tt.stored {
+				t.Errorf("stored = %v, want %v", ok, tt.stored)
+			}
+		})
+	}
+}
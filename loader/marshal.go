@@ -0,0 +1,46 @@
+package loader
+
+import (
+	"bytes"
+	"sync"
+
+	"go_multithreading/appsinstalled"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPooledBuffer keeps the buffer of an unusually large record from being
+// held by the pool.
+const maxPooledBuffer = 64 << 10
+
+// marshalState is the message and buffer a worker reuses to serialize
+// records. Marshaling into it saves allocating the message and its optional
+// fields for every record, and grows no buffer while marshaling; only the
+// exact-size copy handed out is allocated.
+type marshalState struct {
+	msg      appsinstalled.UserApps
+	lat, lon float64
+	buf      []byte
+}
+
+var marshalStates = sync.Pool{
+	New: func() any { return new(marshalState) },
+}
+
+// marshalApps serializes apps through a pooled marshalState. The returned
+// slice is a copy, as items outlive the call in batches and async writes.
+func marshalApps(apps AppsInstalled) ([]byte, error) {
+	st := marshalStates.Get().(*marshalState)
+	st.lat, st.lon = apps.Lat, apps.Lon
+	st.msg.Lat, st.msg.Lon, st.msg.Apps = &st.lat, &st.lon, apps.Apps
+	buf, err := proto.MarshalOptions{}.MarshalAppend(st.buf[:0], &st.msg)
+	var data []byte
+	if err == nil {
+		data = bytes.Clone(buf)
+	}
+	st.msg.Apps = nil
+	if cap(buf) <= maxPooledBuffer {
+		st.buf = buf
+	}
+	marshalStates.Put(st)
+	return data, err
+}
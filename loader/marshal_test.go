@@ -0,0 +1,64 @@
+package loader
+
+import (
+	"bytes"
+	"testing"
+
+	"go_multithreading/appsinstalled"
+	"google.golang.org/protobuf/proto"
+)
+
+func benchApps() AppsInstalled {
+	apps := make([]uint32, 100)
+	for i := range apps {
+		apps[i] = uint32(1000 + i*37)
+	}
+	return AppsInstalled{DevType: "idfa", DevID: "e7e1a50c0ec2747ca56cd9e1558c0d7c", Lat: 67.7835424444, Lon: -22.8044005471, Apps: apps}
+}
+
+func TestMarshalAppsMatchesProto(t *testing.T) {
+	apps := benchApps()
+	want, err := proto.Marshal(&appsinstalled.UserApps{Lat: &apps.Lat, Lon: &apps.Lon, Apps: apps.Apps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := marshalApps(apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second call reuses the pooled buffer, which must not be the one
+	// the first result points into.
+	second, err := marshalApps(AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, want) {
+		t.Errorf("marshalApps = %x, want %x", first, want)
+	}
+	if bytes.Equal(first, second) {
+		t.Error("two records marshaled to the same bytes")
+	}
+}
+
+// BenchmarkMarshalApps compares the pooled marshalApps with a fresh message
+// and proto.Marshal per record, as before the pool.
+func BenchmarkMarshalApps(b *testing.B) {
+	apps := benchApps()
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := marshalApps(apps); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("proto.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			lat, lon := apps.Lat, apps.Lon
+			if _, err := proto.Marshal(&appsinstalled.UserApps{Lat: &lat, Lon: &lon, Apps: apps.Apps}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
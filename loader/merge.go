@@ -0,0 +1,152 @@
+package loader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"go_multithreading/appsinstalled"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxCASAttempts bounds the read-modify-write loop of casSetter when other
+// writers keep changing the same key. Conflicting writers back off for a
+// random, growing delay so they don't collide again right away.
+const (
+	maxCASAttempts = 10
+	casBaseDelay   = 100 * time.Microsecond
+)
+
+// casClient is the part of *memcache.Client casSetter needs.
+type casClient interface {
+	Setter
+	Get(key string) (*memcache.Item, error)
+	CompareAndSwap(item *memcache.Item) error
+}
+
+// casSetter writes with gets and CompareAndSwap: Set reads the stored item,
+// builds the new value from it with update and swaps it in, retrying when
+// another writer changed the key in between, so no write silently replaces
+// a version it hasn't seen. A missing key is added.
+type casSetter struct {
+	mc     casClient
+	update func(stored, value []byte) ([]byte, error)
+}
+
+// newMergeSetter returns the setter of merge mode, which unions the app ids
+// of the stored value with the new record; the new coordinates win.
+func newMergeSetter(mc casClient, opts Options) casSetter {
+	return casSetter{mc: mc, update: func(stored, value []byte) ([]byte, error) {
+		return mergeValues(stored, value, opts)
+	}}
+}
+
+// newOrderedSetter returns the setter of set mode with CAS, which keeps the
+// stored value if it comes after the new one in WriteOrder, so the last
+// record of a key wins whichever writer gets to it first. The record
+// replaced by a later one fails with memcache.ErrNotStored.
+func newOrderedSetter(mc casClient) casSetter {
+	return casSetter{mc: mc, update: func(stored, value []byte) ([]byte, error) {
+		if valueOrder(value).Before(valueOrder(stored)) {
+			return nil, fmt.Errorf("a later record is stored: %w", memcache.ErrNotStored)
+		}
+		return value, nil
+	}}
+}
+
+func (s casSetter) Add(item *memcache.Item) error {
+	return s.mc.Add(item)
+}
+
+func (s casSetter) Set(item *memcache.Item) error {
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(rand.N(casBaseDelay << attempt))
+		}
+		existing, err := s.mc.Get(item.Key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			err = s.mc.Add(item)
+			if errors.Is(err, memcache.ErrNotStored) {
+				// Inserted by another writer since the Get; start over.
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		value, err := s.update(existing.Value, item.Value)
+		if err != nil {
+			return fmt.Errorf("update %s: %w", item.Key, err)
+		}
+		existing.Value = value
+		existing.Expiration = item.Expiration
+		err = s.mc.CompareAndSwap(existing)
+		if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrCacheMiss) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("write %s: %w after %d attempts", item.Key, memcache.ErrCASConflict, maxCASAttempts)
+}
+
+func mergeValues(stored, value []byte, opts Options) ([]byte, error) {
+	old, err := decodeRecord(stored, opts)
+	if err != nil {
+		return nil, fmt.Errorf("stored value: %v", err)
+	}
+	apps, err := decodeRecord(value, opts)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint32]bool, len(old.Apps)+len(apps.Apps))
+	merged := make([]uint32, 0, len(old.Apps)+len(apps.Apps))
+	for _, list := range [][]uint32{old.Apps, apps.Apps} {
+		for _, app := range list {
+			if !seen[app] {
+				seen[app] = true
+				merged = append(merged, app)
+			}
+		}
+	}
+	apps.Apps = merged
+	return encodeRecord(apps, opts)
+}
+
+// decodeRecord reverses encodeRecord for the built-in serializers. Only the
+// value fields are filled in.
+func decodeRecord(value []byte, opts Options) (AppsInstalled, error) {
+	var err error
+	switch {
+	case opts.WithHeader || opts.CAS:
+		_, value, err = DecodeHeader(value)
+	case opts.CompressValues:
+		value, err = DecodeValue(value)
+	}
+	if err != nil {
+		return AppsInstalled{}, err
+	}
+
+	switch opts.Serializer.(type) {
+	case nil, ProtobufSerializer:
+		var ua appsinstalled.UserApps
+		if err := proto.Unmarshal(value, &ua); err != nil {
+			return AppsInstalled{}, err
+		}
+		return AppsInstalled{Lat: ua.GetLat(), Lon: ua.GetLon(), Apps: ua.GetApps()}, nil
+	case JSONSerializer:
+		var v struct {
+			Lat  float64  `json:"lat"`
+			Lon  float64  `json:"lon"`
+			Apps []uint32 `json:"apps"`
+		}
+		if err := json.Unmarshal(value, &v); err != nil {
+			return AppsInstalled{}, err
+		}
+		return AppsInstalled{Lat: v.Lat, Lon: v.Lon, Apps: v.Apps}, nil
+	}
+	return AppsInstalled{}, fmt.Errorf("merge supports only the protobuf and json formats")
+}
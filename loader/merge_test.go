@@ -0,0 +1,229 @@
+package loader
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Merging distinct app ids into one key from many writers at once loses
+// none of them: every write that succeeded is in the stored value.
+func TestMergeSetterConcurrent(t *testing.T) {
+	const writers = 8
+	const perWriter = 10
+	mc := newFakeCAS()
+	opts := Options{}
+	setter := newMergeSetter(mc, opts)
+	// With the key there, no writer starts with an add and its backoff.
+	seed, err := encodeRecord(AppsInstalled{Lat: 1, Lon: 2}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Set(&memcache.Item{Key: "idfa:1", Value: seed})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stored []uint32
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				app := uint32(w*perWriter + i)
+				value, err := encodeRecord(AppsInstalled{DevType: "idfa", DevID: "1", Lat: 1, Lon: 2, Apps: []uint32{app}}, opts)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				err = setter.Set(&memcache.Item{Key: "idfa:1", Value: value})
+				switch {
+				case err == nil:
+					mu.Lock()
+					stored = append(stored, app)
+					mu.Unlock()
+				case !errors.Is(err, memcache.ErrCASConflict):
+					t.Errorf("app %d: %v", app, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	item, err := mc.Get("idfa:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeRecord(item.Value, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(got.Apps)
+	slices.Sort(stored)
+	if !slices.Equal(got.Apps, stored) {
+		t.Errorf("stored apps %v, want the %d written: %v", got.Apps, len(stored), stored)
+	}
+	if mc.conflicts == 0 {
+		t.Error("no write conflicted with another, so the retries were not exercised")
+	}
+	t.Logf("%d of %d writes stored, %d conflicts", len(stored), writers*perWriter, mc.conflicts)
+}
+
+func TestMergeValues(t *testing.T) {
+	opts := Options{}
+	encode := func(apps AppsInstalled) []byte {
+		value, err := encodeRecord(apps, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	tests := []struct {
+		name          string
+		stored, value AppsInstalled
+		want          AppsInstalled
+	}{
+		{"union", AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{1, 2}}, AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{3}},
+			AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{1, 2, 3}}},
+		{"no duplicates", AppsInstalled{Apps: []uint32{1, 2}}, AppsInstalled{Apps: []uint32{2, 1, 4}},
+			AppsInstalled{Apps: []uint32{1, 2, 4}}},
+		{"new coordinates win", AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{1}}, AppsInstalled{Lat: 3, Lon: 4},
+			AppsInstalled{Lat: 3, Lon: 4, Apps: []uint32{1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, err := mergeValues(encode(tt.stored), encode(tt.value), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeRecord(merged, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Lat != tt.want.Lat || got.Lon != tt.want.Lon || !slices.Equal(got.Apps, tt.want.Apps) {
+				t.Errorf("merged %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := mergeValues([]byte("not a record"), encode(AppsInstalled{}), opts); err == nil {
+		t.Error("merging into a corrupt stored value succeeded")
+	}
+}
+
+// Set mode with CAS keeps the last record of a key however the writers
+// interleave: lines written out of order never replace a later one.
+func TestOrderedSetterConcurrent(t *testing.T) {
+	const writers = 8
+	const perWriter = 10
+	mc := newFakeCAS()
+	opts := Options{CAS: true}
+	setter := newOrderedSetter(mc)
+	// With the key there, no writer starts with an add and its backoff.
+	mc.Set(&memcache.Item{Key: "idfa:1", Value: []byte("unordered")})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stored, skipped []uint64
+	start := make(chan struct{})
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			// The writers take turns at the lines, so they race for every
+			// key version and often write a line after a later one.
+			for i := range perWriter {
+				line := uint64(i*writers + writers - w)
+				value, err := encodeRecord(AppsInstalled{DevType: "idfa", DevID: "1", Apps: []uint32{uint32(line)}}, opts)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				value = withOrder(value, WriteOrder{Epoch: 1, Line: line})
+				err = setter.Set(&memcache.Item{Key: "idfa:1", Value: value})
+				mu.Lock()
+				switch {
+				case err == nil:
+					stored = append(stored, line)
+				case errors.Is(err, memcache.ErrNotStored):
+					skipped = append(skipped, line)
+				case !errors.Is(err, memcache.ErrCASConflict):
+					t.Errorf("line %d: %v", line, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	item, err := mc.Get("idfa:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := DecodeHeader(item.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := slices.Max(stored)
+	if header.Version != HeaderVersionOrdered || header.Order != (WriteOrder{Epoch: 1, Line: last}) {
+		t.Errorf("stored header %+v, want version %d with line %d", header, HeaderVersionOrdered, last)
+	}
+	got, err := decodeRecord(item.Value, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Apps, []uint32{uint32(last)}) {
+		t.Errorf("stored apps %v, want the last line's [%d]", got.Apps, last)
+	}
+	if last != writers*perWriter {
+		t.Errorf("last line stored %d, want %d", last, writers*perWriter)
+	}
+	if len(skipped) == 0 || mc.conflicts == 0 {
+		t.Errorf("%d writes skipped, %d conflicts; the ordering and the retries were not both exercised", len(skipped), mc.conflicts)
+	}
+	t.Logf("%d of %d writes stored, %d skipped, %d conflicts", len(stored), writers*perWriter, len(skipped), mc.conflicts)
+}
+
+func TestOrderedSetterStale(t *testing.T) {
+	mc := newFakeCAS()
+	setter := newOrderedSetter(mc)
+	value := func(order WriteOrder) []byte {
+		value, err := encodeRecord(AppsInstalled{Apps: []uint32{uint32(order.Line)}}, Options{CAS: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return withOrder(value, order)
+	}
+	tests := []struct {
+		order WriteOrder
+		want  error
+	}{
+		{WriteOrder{Epoch: 1, Line: 5}, nil},
+		{WriteOrder{Epoch: 1, Line: 3}, memcache.ErrNotStored},
+		{WriteOrder{Epoch: 1, Line: 5}, nil},
+		{WriteOrder{Epoch: 1, Line: 7}, nil},
+		// A later file wins over any line of an earlier one.
+		{WriteOrder{Epoch: 2, Line: 1}, nil},
+		{WriteOrder{Epoch: 1, Line: 9}, memcache.ErrNotStored},
+	}
+	for _, tt := range tests {
+		if err := setter.Set(&memcache.Item{Key: "idfa:1", Value: value(tt.order)}); !errors.Is(err, tt.want) || (err != nil) != (tt.want != nil) {
+			t.Errorf("write of %+v: %v, want %v", tt.order, err, tt.want)
+		}
+	}
+	item, err := mc.Get("idfa:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := valueOrder(item.Value); got != (WriteOrder{Epoch: 2, Line: 1}) {
+		t.Errorf("stored order %+v, want epoch 2 line 1", got)
+	}
+	// A value without an order, as written without -cas, is replaced.
+	mc.Set(&memcache.Item{Key: "idfa:2", Value: []byte("plain")})
+	if err := setter.Set(&memcache.Item{Key: "idfa:2", Value: value(WriteOrder{Line: 1})}); err != nil {
+		t.Errorf("write over an unordered value: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package loader
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	processedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "memc_load_processed_total",
+		Help: "Records successfully written to memcached.",
+	})
+	errorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "memc_load_errors_total",
+		Help: "Records that failed to parse or write.",
+	})
+	processedByType = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "memc_load_processed_by_type_total",
+		Help: "Records successfully written to memcached per device type.",
+	}, []string{"dev_type"})
+	setLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "memc_load_set_duration_seconds",
+		Help:    "Duration of memcached set and add calls per device type.",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05},
+	}, []string{"dev_type"})
+	linesPerSecond = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "memc_load_lines_per_second",
+		Help: "Lines read from input files over the last second.",
+	})
+
+	linesRead atomic.Int64
+)
+
+func ServeMetrics(ctx context.Context, addr string) *http.Server {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(processedTotal, errorsTotal, processedByType, setLatency, linesPerSecond)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		slog.Info("Serving metrics", "addr", addr, "path", "/metrics")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server error", "err", err)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current := linesRead.Load()
+				linesPerSecond.Set(float64(current - last))
+				last = current
+			}
+		}
+	}()
+
+	return server
+}
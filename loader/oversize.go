@@ -0,0 +1,33 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrItemTooLarge is returned for writes memcached rejected because the item
+// exceeds its item size limit, 1MB unless memcached runs with -I.
+var ErrItemTooLarge = errors.New("memcached item too large")
+
+// maxValueSize is the largest value assumed to fit the default item limit,
+// leaving room for the key and the item header.
+const maxValueSize = 1<<20 - 1024
+
+// memcached answers "SERVER_ERROR object too large for cache", which
+// gomemcache only reports as an unexpected response line.
+func tooLargeError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "object too large") {
+		return fmt.Errorf("%w: %v", ErrItemTooLarge, err)
+	}
+	return err
+}
+
+// truncateApps keeps the share of the apps of a record serialized to size
+// bytes that should fit maxValueSize, with a margin as app ids don't all
+// encode to the same length.
+func truncateApps(apps AppsInstalled, size int) AppsInstalled {
+	keep := int(float64(len(apps.Apps)) * maxValueSize / float64(size) * 0.9)
+	apps.Apps = apps.Apps[:min(keep, len(apps.Apps))]
+	return apps
+}
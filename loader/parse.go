@@ -0,0 +1,187 @@
+package loader
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ParseOptions struct {
+	StrictApps   bool
+	StrictGeo    bool
+	StrictFields bool
+	StrictUTF8   bool
+	Normalize    bool
+	// Aliases maps alternate spellings or codes of a device type to the
+	// canonical one; it applies after Normalize.
+	Aliases map[string]string
+	MinApps int
+	MaxApps int
+	// Delimiter separates the fields of a line and AppsDelimiter the app
+	// ids; they default to a tab and a comma.
+	Delimiter     string
+	AppsDelimiter string
+}
+
+var (
+	ErrTooFewApps  = errors.New("too few apps")
+	ErrTooManyApps = errors.New("too many apps")
+)
+
+type ParseError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// NaN and Inf are never valid; the range is only enforced in strict mode since
+// legacy data may use out-of-range sentinel coordinates.
+func checkCoord(field string, v, limit float64, strict bool) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return &ParseError{Field: field, Reason: fmt.Sprintf("%v is not a finite number", v)}
+	}
+	if strict && (v < -limit || v > limit) {
+		return &ParseError{Field: field, Reason: fmt.Sprintf("%v is outside [-%v, %v]", v, limit, limit)}
+	}
+	return nil
+}
+
+var fieldNames = [...]string{"dev_type", "dev_id", "lat", "lon", "apps"}
+
+// checkUTF8 rejects the first field with invalid UTF-8, which would otherwise
+// end up in keys or be silently dropped as a bad app id.
+func checkUTF8(parts []string) error {
+	for i, part := range parts {
+		if utf8.ValidString(part) {
+			continue
+		}
+		field := "line"
+		if i < len(fieldNames) {
+			field = fieldNames[i]
+		}
+		return &ParseError{Field: field, Reason: fmt.Sprintf("invalid UTF-8 in %q", part)}
+	}
+	return nil
+}
+
+// isHeader reports whether line is a column header such as the
+// "dev_type\tdev_id\tlat\tlon\tapps" exports start with.
+func isHeader(line string, opts ParseOptions) bool {
+	delim := opts.Delimiter
+	if delim == "" {
+		delim = "\t"
+	}
+	parts := strings.SplitN(line, delim, 3)
+	return len(parts) >= 2 &&
+		strings.EqualFold(strings.TrimSpace(parts[0]), fieldNames[0]) &&
+		strings.EqualFold(strings.TrimSpace(parts[1]), fieldNames[1])
+}
+
+func ParseAppsInstalled(line string, opts ParseOptions) (*AppsInstalled, error) {
+	delim, appsDelim := opts.Delimiter, opts.AppsDelimiter
+	if delim == "" {
+		delim = "\t"
+	}
+	if appsDelim == "" {
+		appsDelim = ","
+	}
+
+	parts := strings.Split(line, delim)
+	if len(parts) < 5 {
+		return nil, &ParseError{Field: "line", Reason: fmt.Sprintf("expected 5 fields, got %d", len(parts))}
+	}
+	if opts.StrictUTF8 {
+		if err := checkUTF8(parts); err != nil {
+			return nil, err
+		}
+	}
+	// Columns after the apps field are ignored unless strict; empty ones left
+	// by trailing delimiters are always accepted.
+	if opts.StrictFields && len(parts) > 5 && strings.Join(parts[5:], "") != "" {
+		return nil, &ParseError{Field: "line", Reason: fmt.Sprintf("expected 5 fields, got %d", len(parts))}
+	}
+
+	devType := strings.TrimSpace(parts[0])
+	if opts.Normalize {
+		devType = strings.ToLower(devType)
+	}
+	if canonical, ok := opts.Aliases[devType]; ok {
+		devType = canonical
+	}
+	devID := strings.TrimSpace(parts[1])
+
+	appsStr := strings.Split(parts[4], appsDelim)
+	var apps []uint32
+	for _, app := range appsStr {
+		app = strings.TrimSpace(app)
+		if app == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(app, 10, 32)
+		if err != nil {
+			if opts.StrictApps {
+				return nil, &ParseError{Field: "apps", Reason: fmt.Sprintf("bad app id %q", app)}
+			}
+			continue
+		}
+		apps = append(apps, uint32(id))
+	}
+	if len(apps) < opts.MinApps {
+		return nil, &ParseError{Field: "apps", Reason: fmt.Sprintf("%d apps, want at least %d", len(apps), opts.MinApps), Err: ErrTooFewApps}
+	}
+	if opts.MaxApps > 0 && len(apps) > opts.MaxApps {
+		return nil, &ParseError{Field: "apps", Reason: fmt.Sprintf("%d apps, want at most %d", len(apps), opts.MaxApps), Err: ErrTooManyApps}
+	}
+
+	lat, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return nil, &ParseError{Field: "lat", Reason: fmt.Sprintf("%q is not a number", parts[2])}
+	}
+	lon, err := strconv.ParseFloat(parts[3], 64)
+	if err != nil {
+		return nil, &ParseError{Field: "lon", Reason: fmt.Sprintf("%q is not a number", parts[3])}
+	}
+
+	record := &AppsInstalled{
+		DevType: devType,
+		DevID:   devID,
+		Lat:     lat,
+		Lon:     lon,
+		Apps:    apps,
+	}
+	if err := record.validate(opts.StrictGeo); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Validate checks that a record can be stored: device type and id are set
+// and the coordinates are finite and within [-90, 90] and [-180, 180]. App
+// ids are unsigned, so they need no check.
+func (a AppsInstalled) Validate() error {
+	return a.validate(true)
+}
+
+func (a AppsInstalled) validate(strictGeo bool) error {
+	if a.DevType == "" {
+		return &ParseError{Field: "dev_type", Reason: "empty"}
+	}
+	if a.DevID == "" {
+		return &ParseError{Field: "dev_id", Reason: "empty"}
+	}
+	if err := checkCoord("lat", a.Lat, 90, strictGeo); err != nil {
+		return err
+	}
+	return checkCoord("lon", a.Lon, 180, strictGeo)
+}
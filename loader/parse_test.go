@@ -0,0 +1,102 @@
+package loader
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// parseTest is a line and either the record it parses to or the field of
+// the ParseError it fails with.
+type parseTest struct {
+	name    string
+	line    string
+	opts    ParseOptions
+	want    *AppsInstalled
+	errWant string
+}
+
+func runParseTests(t *testing.T, tests []parseTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAppsInstalled(tt.line, tt.opts)
+			if tt.errWant != "" {
+				var pe *ParseError
+				if !errors.As(err, &pe) {
+					t.Fatalf("err = %v, want a ParseError of %s", err, tt.errWant)
+				}
+				if pe.Field != tt.errWant {
+					t.Fatalf("err = %v, want a ParseError of %s", err, tt.errWant)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got.DevType != tt.want.DevType || got.DevID != tt.want.DevID ||
+				got.Lat != tt.want.Lat || got.Lon != tt.want.Lon || !slices.Equal(got.Apps, tt.want.Apps) {
+				t.Errorf("got %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	record := &AppsInstalled{DevType: "idfa", DevID: "1rfw", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2, 3}}
+	strict := ParseOptions{StrictFields: true}
+	runParseTests(t, []parseTest{
+		{name: "exactly five", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3", want: record},
+		{name: "exactly five strict", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3", opts: strict, want: record},
+		{name: "trailing tab", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\t", want: record},
+		{name: "trailing tabs strict", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\t\t", opts: strict, want: record},
+		{name: "extra column ignored", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\textra", want: record},
+		{name: "extra columns ignored", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\t\t7,8", want: record},
+		{name: "extra column strict", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\textra", opts: strict, errWant: "line"},
+		{name: "extra column after empty strict", line: "idfa\t1rfw\t55.55\t42.42\t1,2,3\t\textra", opts: strict, errWant: "line"},
+		{name: "four fields", line: "idfa\t1rfw\t55.55\t42.42", errWant: "line"},
+		{name: "empty apps", line: "idfa\t1rfw\t55.55\t42.42\t",
+			want: &AppsInstalled{DevType: "idfa", DevID: "1rfw", Lat: 55.55, Lon: 42.42}},
+		{name: "empty dev_id", line: "idfa\t\t55.55\t42.42\t1,2,3", errWant: "dev_id"},
+		{name: "empty lat", line: "idfa\t1rfw\t\t42.42\t1,2,3", errWant: "lat"},
+		{name: "empty lon", line: "idfa\t1rfw\t55.55\t\t1,2,3", errWant: "lon"},
+		{name: "empty app ids skipped", line: "idfa\t1rfw\t55.55\t42.42\t1,,2,,3,", want: record},
+	})
+}
+
+func TestParseNormalize(t *testing.T) {
+	record := &AppsInstalled{DevType: "idfa", DevID: "1RfW", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2}}
+	normalize := ParseOptions{Normalize: true}
+	runParseTests(t, []parseTest{
+		{name: "surrounding spaces", line: "  idfa \t 1RfW  \t55.55\t42.42\t1,2", want: record},
+		{name: "surrounding spaces normalized", line: " IDFA \t 1RfW \t55.55\t42.42\t1,2", opts: normalize, want: record},
+		{name: "mixed case normalized", line: "IdFa\t1RfW\t55.55\t42.42\t1,2", opts: normalize, want: record},
+		{name: "mixed case kept", line: "IdFa\t1RfW\t55.55\t42.42\t1,2",
+			want: &AppsInstalled{DevType: "IdFa", DevID: "1RfW", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2}}},
+		{name: "dev_id keeps its case", line: "idfa\t1RfW\t55.55\t42.42\t1,2", opts: normalize, want: record},
+		{name: "alias after normalize", line: "IDFA_LEGACY\t1RfW\t55.55\t42.42\t1,2",
+			opts: ParseOptions{Normalize: true, Aliases: map[string]string{"idfa_legacy": "idfa"}}, want: record},
+		{name: "blank dev_id", line: "idfa\t   \t55.55\t42.42\t1,2", errWant: "dev_id"},
+		{name: "blank dev_type", line: " \t1RfW\t55.55\t42.42\t1,2", opts: normalize, errWant: "dev_type"},
+	})
+}
+
+func TestParseStrictUTF8(t *testing.T) {
+	strict := ParseOptions{StrictUTF8: true}
+	runParseTests(t, []parseTest{
+		{name: "valid multibyte", line: "idfa\tустройство\t55.55\t42.42\t1,2", opts: strict,
+			want: &AppsInstalled{DevType: "idfa", DevID: "устройство", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2}}},
+		{name: "invalid dev_type", line: "id\xfffa\t1rfw\t55.55\t42.42\t1,2", opts: strict, errWant: "dev_type"},
+		{name: "invalid dev_id", line: "idfa\t1r\xc3\x28fw\t55.55\t42.42\t1,2", opts: strict, errWant: "dev_id"},
+		{name: "truncated rune in dev_id", line: "idfa\t1rfw\xd0\t55.55\t42.42\t1,2", opts: strict, errWant: "dev_id"},
+		{name: "invalid lat", line: "idfa\t1rfw\t55.\xff55\t42.42\t1,2", opts: strict, errWant: "lat"},
+		{name: "invalid apps", line: "idfa\t1rfw\t55.55\t42.42\t1,\xfe,2", opts: strict, errWant: "apps"},
+		{name: "invalid extra column", line: "idfa\t1rfw\t55.55\t42.42\t1,2\t\xff", opts: strict, errWant: "line"},
+		{name: "surrogate half", line: "idfa\t1rfw\xed\xa0\x80\t55.55\t42.42\t1,2", opts: strict, errWant: "dev_id"},
+		// Without StrictUTF8 the bytes are kept as they are.
+		{name: "invalid dev_id kept", line: "idfa\t1r\xc3\x28fw\t55.55\t42.42\t1,2",
+			want: &AppsInstalled{DevType: "idfa", DevID: "1r\xc3\x28fw", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2}}},
+		{name: "invalid app id dropped", line: "idfa\t1rfw\t55.55\t42.42\t1,\xfe,2",
+			want: &AppsInstalled{DevType: "idfa", DevID: "1rfw", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2}}},
+	})
+}
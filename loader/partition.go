@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// partition routes parsed records to writers dedicated to their device type,
+// so the connections of each backend are used by a fixed set of goroutines
+// instead of by every worker.
+type partition struct {
+	queues map[string]chan typedRecord
+	wg     sync.WaitGroup
+}
+
+type typedRecord struct {
+	apps *AppsInstalled
+	line inputLine
+}
+
+// startPartition splits opts.Workers writers evenly between the device
+// types, at least one each. They stop taking records once ctx is done and
+// write with writeCtx, see writeContext.
+func startPartition(ctx, writeCtx context.Context, logger *slog.Logger, guard *workerGuard, mcClients map[string]*memcache.Client, opts Options, stats *Stats, cp *checkpointer) *partition {
+	p := &partition{queues: make(map[string]chan typedRecord, len(mcClients))}
+	perType := max(opts.Workers/len(mcClients), 1)
+	for devType := range mcClients {
+		queue := make(chan typedRecord, max(opts.Buffer/len(mcClients), 1))
+		p.queues[devType] = queue
+		for i := 0; i < perType; i++ {
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				defer guard.catch()
+				local := stats.workerStats()
+				defer stats.Add(local)
+				w := newRecordWriter(writeCtx, logger, mcClients, opts, local, cp)
+
+				var flushTick <-chan time.Time
+				if opts.BatchFlushInterval > 0 && opts.BatchSize > 1 && !opts.DryRun {
+					ticker := time.NewTicker(opts.BatchFlushInterval)
+					defer ticker.Stop()
+					flushTick = ticker.C
+				}
+			loop:
+				for {
+					select {
+					case rec, ok := <-queue:
+						if !ok || ctx.Err() != nil {
+							break loop
+						}
+						w.write(rec.apps, rec.line)
+					case <-flushTick:
+						w.flushStale()
+					}
+				}
+				w.flushAll()
+			}()
+		}
+	}
+	return p
+}
+
+func (p *partition) send(ctx context.Context, apps *AppsInstalled, line inputLine) bool {
+	select {
+	case p.queues[apps.DevType] <- typedRecord{apps, line}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close waits for the writers once no more records are sent.
+func (p *partition) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
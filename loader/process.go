@@ -0,0 +1,592 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// ErrDecompress marks inputs whose compressed stream is corrupt or truncated.
+var ErrDecompress = errors.New("corrupt compressed input")
+
+type decompressReader struct {
+	io.ReadCloser
+}
+
+func (r decompressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+	return n, err
+}
+
+// pgzip reads ahead 4 blocks of 1MB by default; lowMem cuts that to these.
+const (
+	lowMemGzipBlockSize = 256 << 10
+	lowMemGzipBlocks    = 2
+)
+
+func openInput(file io.Reader, lowMem bool) (io.ReadCloser, error) {
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(4)
+	var zr io.ReadCloser
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		// pgzip inflates ahead in its own goroutine, so decompression overlaps
+		// with line scanning instead of stalling the producer.
+		var gz *pgzip.Reader
+		var err error
+		if lowMem {
+			gz, err = pgzip.NewReaderN(br, lowMemGzipBlockSize, lowMemGzipBlocks)
+		} else {
+			gz, err = pgzip.NewReader(br)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecompress, err)
+		}
+		// Concatenated members are read as one stream, which is the default
+		// but is what keeps their tail from being dropped. A corrupt member
+		// or trailing garbage fails the read like a truncated file.
+		gz.Multistream(true)
+		zr = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		zd, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecompress, err)
+		}
+		zr = zd.IOReadCloser()
+	case bytes.HasPrefix(magic, bzip2Magic) && len(magic) == 4 && magic[3] >= '1' && magic[3] <= '9':
+		// The magic ends with the block size, so text starting with "BZh" is
+		// not taken for bzip2.
+		// compress/bzip2 decodes sequentially, so these files are slower.
+		zr = io.NopCloser(bzip2.NewReader(br))
+	default:
+		return io.NopCloser(br), nil
+	}
+	return decompressReader{zr}, nil
+}
+
+func newLogger(name string) *slog.Logger {
+	return slog.Default().With("file", filepath.Base(name))
+}
+
+func ProcessFile(ctx context.Context, filename string, mcClients map[string]*memcache.Client, opts Options) (*Result, error) {
+	start := time.Now()
+	result := &Result{Name: filename}
+	err := processFile(ctx, filename, mcClients, opts, result)
+	result.finish(start, err)
+	return result, err
+}
+
+func processFile(ctx context.Context, filename string, mcClients map[string]*memcache.Client, opts Options, result *Result) error {
+	logger := newLogger(filename)
+	logger.Info("Processing file", "path", filename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	input, err := openInput(file, opts.LowMem)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	var cp *checkpointer
+	if opts.CheckpointEvery > 0 && !opts.Dedup && !opts.DryRun && !opts.VerifyOnly && !opts.Diff {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		cp = openCheckpointer(logger, filename, info, opts.CheckpointEvery)
+	}
+
+	if err := processInput(ctx, logger, filename, input, mcClients, opts, cp, result); err != nil {
+		return err
+	}
+	if err := cp.remove(); err != nil {
+		return err
+	}
+	if result.Status == StatusEmpty {
+		return nil
+	}
+	if result.Truncated {
+		logger.Info("Line limit reached, file is left in place", "limit", opts.Limit)
+		return nil
+	}
+	if opts.DryRun || opts.VerifyOnly || opts.Diff {
+		return nil
+	}
+	donePath, err := finishFile(filename, opts.DoneAction)
+	if err != nil {
+		return err
+	}
+	result.DonePath = donePath
+	return nil
+}
+
+func ProcessReader(ctx context.Context, name string, r io.Reader, mcClients map[string]*memcache.Client, opts Options) (*Result, error) {
+	start := time.Now()
+	result := &Result{Name: name}
+	err := processInput(ctx, newLogger(name), name, r, mcClients, opts, nil, result)
+	result.finish(start, err)
+	return result, err
+}
+
+// workerGuard recovers panicking workers. The first panic cancels the file,
+// which also unblocks the producer instead of leaving it waiting on a channel
+// no one reads.
+type workerGuard struct {
+	logger   *slog.Logger
+	cancel   context.CancelFunc
+	panicked atomic.Pointer[string]
+}
+
+func (g *workerGuard) catch() {
+	if r := recover(); r != nil {
+		msg := fmt.Sprint(r)
+		g.logger.Error("Worker panicked, stopping file", "panic", msg, "stack", string(debug.Stack()))
+		g.panicked.CompareAndSwap(nil, &msg)
+		g.cancel()
+	}
+}
+
+func (g *workerGuard) err() error {
+	if msg := g.panicked.Load(); msg != nil {
+		return fmt.Errorf("worker panic: %s", *msg)
+	}
+	return nil
+}
+
+type inputLine struct {
+	num  int
+	text string
+}
+
+// writeContext returns the context of the writes of a file stopped through
+// ctx. Records already handed to a writer are written even once a signal,
+// -fail-fast or a failing chunk stops the file; only the deadline of ctx,
+// from -timeout, cuts them short.
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	writeCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(writeCtx, deadline)
+	}
+	return context.WithCancel(writeCtx)
+}
+
+func processInput(ctx context.Context, logger *slog.Logger, name string, input io.Reader, mcClients map[string]*memcache.Client, opts Options, cp *checkpointer, result *Result) error {
+	writeCtx, cancelWrites := writeContext(ctx)
+	defer cancelWrites()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts.CAS && opts.CASEpoch == 0 {
+		opts.CASEpoch = time.Now().UnixNano()
+	}
+
+	stats := Stats{live: &liveCounts{}}
+	result.Stats = &stats
+	defer func() {
+		result.Processed = stats.Processed
+		result.Errors = stats.Errors
+		result.VerifyFailures = stats.VerifyFailures
+		result.SkippedExisting = stats.SkippedExisting
+		result.DiffNew = stats.DiffNew
+		result.DiffChanged = stats.DiffChanged
+		result.DiffUnchanged = stats.DiffUnchanged
+		result.TooLarge = stats.TooLarge
+	}()
+	if opts.ChunkSize > 0 {
+		cp.checkChunks(opts.ErrRate, cancel)
+	}
+	lines := make(chan inputLine, opts.Buffer)
+	var starved, blocked atomic.Int64
+	var wg sync.WaitGroup
+	guard := &workerGuard{logger: logger, cancel: cancel}
+
+	var unknownSeen sync.Map
+
+	var dedup *dedupMap
+	if opts.Dedup {
+		dedup = newDedupMap()
+	}
+
+	// Workers only parse when records are partitioned by type.
+	var part *partition
+	if opts.PartitionByType && dedup == nil && !opts.ParseOnly {
+		part = startPartition(ctx, writeCtx, logger, guard, mcClients, opts, &stats, cp)
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer guard.catch()
+			local := stats.workerStats()
+			defer stats.Add(local)
+			w := newRecordWriter(writeCtx, logger, mcClients, opts, local, cp)
+
+			// Batches of a slow stream are flushed by age as well as by size.
+			var flushTick <-chan time.Time
+			if opts.BatchFlushInterval > 0 && opts.BatchSize > 1 && !opts.DryRun && part == nil {
+				ticker := time.NewTicker(opts.BatchFlushInterval)
+				defer ticker.Stop()
+				flushTick = ticker.C
+			}
+
+			recv := func() (inputLine, bool) {
+				select {
+				case <-flushTick:
+					w.flushStale()
+				default:
+				}
+				select {
+				case line, ok := <-lines:
+					return line, ok
+				default:
+					starved.Add(1)
+				}
+				for {
+					select {
+					case line, ok := <-lines:
+						return line, ok
+					case <-flushTick:
+						w.flushStale()
+					}
+				}
+			}
+
+			for line, ok := recv(); ok; line, ok = recv() {
+				if ctx.Err() != nil {
+					break
+				}
+				// Tabs are kept so a trailing empty apps column still counts.
+				line.text = strings.Trim(line.text, " \r\n")
+				if strings.TrimSpace(line.text) == "" || strings.HasPrefix(line.text, "#") || isHeader(line.text, opts.Parse) {
+					cp.lineSkipped(line.num)
+					continue
+				}
+				if opts.SampleRate > 0 && opts.SampleRate < 1 && !keepLine(line.num, opts.SampleRate, opts.SampleSeed) {
+					local.addSampledOut()
+					cp.lineSkipped(line.num)
+					continue
+				}
+
+				apps, err := ParseAppsInstalled(line.text, opts.Parse)
+				if err != nil {
+					logger.Debug("Cannot parse line", "line", line.text, "err", err)
+					local.addParseError(err)
+					opts.DLQ.add(err.Error(), line.text)
+					cp.lineFailed(line.num)
+					continue
+				}
+
+				if opts.Filter != nil && !opts.Filter.MatchString(filterValue(apps, opts.FilterField)) {
+					local.addFilteredOut()
+					cp.lineSkipped(line.num)
+					continue
+				}
+
+				if _, ok := mcClients[apps.DevType]; !ok {
+					if _, seen := unknownSeen.LoadOrStore(apps.DevType, true); !seen {
+						logger.Warn("Unknown device type, further lines are counted silently", "dev_type", apps.DevType)
+					}
+					local.addUnknownType(apps.DevType)
+					opts.DLQ.add("unknown device type "+apps.DevType, line.text)
+					cp.lineFailed(line.num)
+					continue
+				}
+
+				if opts.ParseOnly {
+					local.addProcessed(apps.DevType, 1)
+					continue
+				}
+
+				if dedup != nil || opts.CrossDupes != nil {
+					key, err := itemKey(*apps, opts)
+					if err != nil {
+						logger.Error("Cannot build key", "err", err)
+						local.addErrors(apps.DevType, 1)
+						opts.DLQ.add("key: "+err.Error(), line.text)
+						cp.lineFailed(line.num)
+						continue
+					}
+					opts.CrossDupes.add(name, key)
+					if dedup != nil {
+						dedup.put(key, line.num, apps, line.text)
+						continue
+					}
+				}
+				if part != nil {
+					if !part.send(ctx, apps, line) {
+						break
+					}
+					continue
+				}
+				w.write(apps, line)
+			}
+
+			w.flushAll()
+		}()
+	}
+
+	var read atomic.Int64
+	if opts.ProgressInterval > 0 {
+		stopProgress := make(chan struct{})
+		defer close(stopProgress)
+		go reportProgress(logger, opts.ProgressInterval, &read, &stats, stopProgress)
+	}
+
+	maxLine := opts.MaxLine
+	if maxLine <= 0 {
+		maxLine = bufio.MaxScanTokenSize
+	}
+	splitter := &lineSplitter{max: maxLine, sep: '\n'}
+	if opts.RecordSep != "" {
+		splitter.sep = opts.RecordSep[0]
+	}
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, min(maxLine, bufio.MaxScanTokenSize)), maxLine+1)
+	scanner.Split(splitter.split)
+	var lineCount int
+	skip := cp.skip()
+scan:
+	for scanner.Scan() {
+		// A line past the limit means the input was cut short.
+		if opts.Limit > 0 && lineCount >= opts.Limit {
+			result.Truncated = true
+			break
+		}
+		if lineCount < skip {
+			lineCount++
+			continue
+		}
+		if splitter.tooLong {
+			logger.Warn("Line is too long, skipping it", "line", lineCount+1, "max_bytes", maxLine)
+			stats.addErrors("", 1)
+			cp.lineFailed(lineCount)
+			lineCount++
+			read.Add(1)
+			linesRead.Add(1)
+			continue
+		}
+		line := inputLine{num: lineCount, text: scanner.Text()}
+		select {
+		case lines <- line:
+		default:
+			blocked.Add(1)
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				break scan
+			}
+		}
+		lineCount++
+		read.Add(1)
+		linesRead.Add(1)
+	}
+	logger.Info("Read lines", "lines", lineCount, "skipped", min(skip, lineCount))
+	result.Lines = lineCount
+	readErr := scanner.Err()
+	if readErr != nil {
+		// Stop the workers right away: the rest of the input is lost, so the
+		// file has to be retried as a whole anyway.
+		cancel()
+	}
+	close(lines)
+	wg.Wait()
+	if part != nil {
+		part.close()
+	}
+	logger.Info("Channel usage", "workers_starved", starved.Load(), "producer_blocked", blocked.Load(),
+		"workers", opts.Workers, "buffer", opts.Buffer)
+
+	logUnknownTypes(logger, &stats)
+
+	if err := guard.err(); err != nil {
+		return err
+	}
+	if err := cp.chunkErr(ctx.Err() == nil && readErr == nil); err != nil {
+		return err
+	}
+
+	if readErr != nil {
+		logger.Error("Input is truncated or corrupt, leaving it for retry", "lines", lineCount,
+			"processed", stats.Processed, "errors", stats.Errors, "err", readErr)
+		return fmt.Errorf("read %s: %w", name, readErr)
+	}
+
+	if dedup != nil {
+		writeDeduped(ctx, writeCtx, logger, guard, dedup, mcClients, opts, &stats)
+		if err := guard.err(); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		logger.Warn("Interrupted", "processed", stats.Processed, "errors", stats.Errors)
+		result.Status = StatusInterrupted
+		return ctx.Err()
+	}
+
+	result.Status = StatusOK
+	// The rate is the failed share of every attempted record. Keys skipped in
+	// add mode were handled fine and count as attempted.
+	attempted := stats.Processed + stats.SkippedExisting + stats.Errors
+	if attempted == 0 {
+		// Blank, comment and header lines only, so there was nothing to load.
+		result.Empty = true
+		if opts.WarnEmpty {
+			logger.Warn("Empty input, leaving it in place", "lines", result.Lines)
+			result.Status = StatusEmpty
+		} else {
+			logger.Info("Empty input, nothing to load", "lines", result.Lines)
+		}
+		return nil
+	}
+
+	errRate := float64(stats.Errors) / float64(attempted)
+	result.ErrRate = errRate
+	if errRate < opts.ErrRate {
+		logger.Info("Acceptable error rate. Successful load", "err_rate", errRate, "attempted", attempted,
+			"processed", stats.Processed, "errors", stats.Errors)
+	} else if stats.Processed == 0 && stats.SkippedExisting == 0 {
+		logger.Warn("All records failed. Failed load", "attempted", attempted, "errors", stats.Errors)
+		result.Status = StatusHighErrorRate
+	} else {
+		logger.Warn("High error rate. Failed load", "err_rate", errRate, "threshold", opts.ErrRate, "attempted", attempted,
+			"processed", stats.Processed, "errors", stats.Errors)
+		result.Status = StatusHighErrorRate
+	}
+	checkTypeErrRates(logger, &stats, opts.ErrRate)
+	return nil
+}
+
+func logUnknownTypes(logger *slog.Logger, stats *Stats) {
+	devTypes := make([]string, 0, len(stats.UnknownTypes))
+	for devType := range stats.UnknownTypes {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+	for _, devType := range devTypes {
+		logger.Warn("Lines with unknown device type", "dev_type", devType, "lines", stats.UnknownTypes[devType])
+	}
+}
+
+// A failing device type can hide behind healthy traffic of the others in the
+// file-wide rate, so every type is checked on its own as well.
+func checkTypeErrRates(logger *slog.Logger, stats *Stats, threshold float64) {
+	devTypes := make([]string, 0, len(stats.ByType))
+	for devType := range stats.ByType {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+
+	for _, devType := range devTypes {
+		ts := stats.ByType[devType]
+		if ts.Processed == 0 {
+			if ts.Errors > 0 {
+				logger.Warn("All records of device type failed", "dev_type", devType, "errors", ts.Errors)
+			}
+			continue
+		}
+		attempted := ts.Processed + ts.Errors
+		errRate := float64(ts.Errors) / float64(attempted)
+		if errRate >= threshold {
+			logger.Warn("High error rate for device type", "dev_type", devType, "err_rate", errRate,
+				"threshold", threshold, "attempted", attempted, "processed", ts.Processed, "errors", ts.Errors)
+		}
+	}
+}
+
+func reportProgress(logger *slog.Logger, interval time.Duration, read *atomic.Int64, stats *Stats, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last int64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := read.Load()
+			processed, errors := stats.counts()
+			logger.Info("Progress", "lines", current, "processed", processed, "errors", errors,
+				"lines_per_sec", float64(current-last)/interval.Seconds())
+			last = current
+		}
+	}
+}
+
+func writeDeduped(ctx, writeCtx context.Context, logger *slog.Logger, guard *workerGuard, dedup *dedupMap, mcClients map[string]*memcache.Client, opts Options, stats *Stats) {
+	records := make(chan dedupEntry, opts.Buffer)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer guard.catch()
+			local := stats.workerStats()
+			defer stats.Add(local)
+			w := newRecordWriter(writeCtx, logger, mcClients, opts, local, nil)
+			for entry := range records {
+				if ctx.Err() != nil {
+					break
+				}
+				w.write(entry.apps, inputLine{num: entry.num, text: entry.line})
+			}
+			w.flushAll()
+		}()
+	}
+
+	send := func(entry dedupEntry) bool {
+		select {
+		case records <- entry:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// A single worker writes in input order, so the records go to it in
+	// that order too.
+	if opts.Workers == 1 {
+		for _, entry := range dedup.ordered() {
+			if !send(entry) {
+				break
+			}
+		}
+	} else {
+		for _, entry := range dedup.entries {
+			if !send(entry) {
+				break
+			}
+		}
+	}
+	close(records)
+	wg.Wait()
+	logger.Info("Dedup", "unique_keys", len(dedup.entries), "duplicates_dropped", dedup.dropped)
+}
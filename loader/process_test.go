@@ -0,0 +1,691 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// testClients has every device type of the fixtures. Records go to
+// Options.Sink, so the clients are never used.
+var testClients = map[string]*memcache.Client{"idfa": nil, "gaid": nil, "adid": nil, "dvid": nil}
+
+// testOptions loads into sink with a few workers and the default error rate.
+func testOptions(sink Sink) Options {
+	return Options{
+		ErrRate:   DefaultErrRate,
+		Workers:   4,
+		Buffer:    100,
+		BatchSize: 1,
+		Sink:      sink,
+	}
+}
+
+// writeGzip writes lines, each ended by a newline, as a gzipped file in a
+// temporary directory and returns its path.
+func writeGzip(t testing.TB, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(file)
+	for _, line := range lines {
+		fmt.Fprintln(zw, line)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLowMemBounded(t *testing.T) {
+	const (
+		lines   = 20000
+		apps    = 1000
+		maxHeap = 32 << 20
+	)
+	// Every line is about 5KB, so the input is about 100MB, and only 100
+	// distinct keys keep the sink small.
+	path := filepath.Join(t.TempDir(), "big.tsv.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw, _ := gzip.NewWriterLevel(file, gzip.BestSpeed)
+	bw := bufio.NewWriter(zw)
+	ids := make([]string, apps)
+	for i := range ids {
+		ids[i] = fmt.Sprint(1000 + i)
+	}
+	appList := strings.Join(ids, ",")
+	inputBytes := 0
+	for i := range lines {
+		n, _ := fmt.Fprintf(bw, "idfa\tdev%d\t55.55\t42.42\t%s\n", i%100, appList)
+		inputBytes += n
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	file.Close()
+
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.LowMem = true
+	opts.Buffer = opts.Workers
+	opts.BatchSize = 10
+	opts.MaxLine = 1 << 20
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := make(chan uint64)
+	stop := make(chan struct{})
+	go func() {
+		var max uint64
+		var ms runtime.MemStats
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				peak <- max
+				return
+			case <-ticker.C:
+				runtime.ReadMemStats(&ms)
+				if ms.HeapInuse > before.HeapInuse+max {
+					max = ms.HeapInuse - before.HeapInuse
+				}
+			}
+		}
+	}()
+	result, err := ProcessFile(context.Background(), path, testClients, opts)
+	close(stop)
+	grown := <-peak
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Processed != lines || result.Errors != 0 {
+		t.Errorf("processed %d, errors %d, want %d and 0", result.Processed, result.Errors, lines)
+	}
+	if got := sink.callCount(); got != lines {
+		t.Errorf("sink got %d writes, want %d", got, lines)
+	}
+	if grown > maxHeap {
+		t.Errorf("heap grew by %dMB while loading %dMB, want at most %dMB", grown>>20, inputBytes>>20, maxHeap>>20)
+	}
+	t.Logf("heap grew by at most %dMB while loading %dMB", grown>>20, inputBytes>>20)
+}
+
+// fixtureLines returns good records of every device type followed by bad
+// lines that fail to parse.
+func fixtureLines(good, bad int) []string {
+	devTypes := []string{"idfa", "gaid", "adid", "dvid"}
+	var lines []string
+	for i := range good {
+		lines = append(lines, fmt.Sprintf("%s\tdev%d\t%d.5\t-%d.25\t%d,%d", devTypes[i%len(devTypes)], i, i%90, i%180, i, i+1))
+	}
+	for i := range bad {
+		lines = append(lines, fmt.Sprintf("bad line %d", i))
+	}
+	return lines
+}
+
+func TestProcessFileFixture(t *testing.T) {
+	lines := append(fixtureLines(8, 0), "", "# comment", "idfa\tdev100\tnorth\t42\t1", "unknown\tdev101\t1\t2\t3")
+	path := writeGzip(t, "fixture.tsv.gz", lines...)
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.ErrRate = 0.5
+
+	result, err := ProcessFile(context.Background(), path, testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != StatusOK || result.Processed != 8 || result.Errors != 2 || result.Lines != 12 {
+		t.Errorf("status %s, processed %d, errors %d, lines %d; want ok, 8, 2, 12",
+			result.Status, result.Processed, result.Errors, result.Lines)
+	}
+	stats := result.Stats
+	if stats.ParseErrors != 1 || stats.UnknownTypes["unknown"] != 1 {
+		t.Errorf("parse errors %d, unknown types %v; want 1 and unknown=1", stats.ParseErrors, stats.UnknownTypes)
+	}
+	for _, devType := range []string{"idfa", "gaid", "adid", "dvid"} {
+		if got := stats.ByType[devType].Processed; got != 2 {
+			t.Errorf("%s processed %d, want 2", devType, got)
+		}
+	}
+
+	if sink.len() != 8 {
+		t.Errorf("sink has %d keys, want 8", sink.len())
+	}
+	for _, line := range lines[:8] {
+		want, err := ParseAppsInstalled(line, ParseOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := want.DevType + ":" + want.DevID
+		value, ok := sink.value(key)
+		if !ok {
+			t.Errorf("key %s was not written", key)
+			continue
+		}
+		got, err := decodeRecord(value, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if got.Lat != want.Lat || got.Lon != want.Lon || !slices.Equal(got.Apps, want.Apps) {
+			t.Errorf("%s = %+v, want %+v", key, got, *want)
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("loaded file is still in place: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(path), ".fixture.tsv.gz"); result.DonePath != want {
+		t.Errorf("done path %q, want %q", result.DonePath, want)
+	}
+}
+
+func TestProcessFileErrRate(t *testing.T) {
+	tests := []struct {
+		name       string
+		good, bad  int
+		wantStatus string
+	}{
+		// 9 of 100 is just under the 0.1 threshold, 10 of 100 reaches it.
+		{"just under", 91, 9, StatusOK},
+		{"just over", 89, 11, StatusHighErrorRate},
+		{"at threshold", 90, 10, StatusHighErrorRate},
+		// The file is still marked done, as it has been read in full.
+		{"all bad", 0, 5, StatusHighErrorRate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeGzip(t, "rate.tsv.gz", fixtureLines(tt.good, tt.bad)...)
+			opts := testOptions(newFakeSetter())
+			opts.ErrRate = 0.1
+			result, err := ProcessFile(context.Background(), path, testClients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != tt.wantStatus || result.Processed != tt.good || result.Errors != tt.bad {
+				t.Errorf("status %s, processed %d, errors %d; want %s, %d, %d",
+					result.Status, result.Processed, result.Errors, tt.wantStatus, tt.good, tt.bad)
+			}
+			if result.DonePath == "" {
+				t.Error("file was not marked done")
+			}
+		})
+	}
+}
+
+func TestProcessFileEmpty(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"no lines", nil},
+		{"whitespace only", []string{"", "   ", "\t", " \r"}},
+		{"header only", []string{"dev_type\tdev_id\tlat\tlon\tapps"}},
+		{"header and comments", []string{"# export", "DEV_TYPE\tDEV_ID\tLAT\tLON\tAPPS", ""}},
+	}
+	for _, tt := range tests {
+		for _, warn := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s warn=%v", tt.name, warn), func(t *testing.T) {
+				path := writeGzip(t, "empty.tsv.gz", tt.lines...)
+				opts := testOptions(newFakeSetter())
+				opts.WarnEmpty = warn
+				result, err := ProcessFile(context.Background(), path, testClients, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantStatus := StatusOK
+				if warn {
+					wantStatus = StatusEmpty
+				}
+				if result.Status != wantStatus || !result.Empty || result.Lines != len(tt.lines) || result.Errors != 0 {
+					t.Errorf("status %s, empty %v, lines %d, errors %d; want %s, true, %d, 0",
+						result.Status, result.Empty, result.Lines, result.Errors, wantStatus, len(tt.lines))
+				}
+				_, statErr := os.Stat(path)
+				if moved := os.IsNotExist(statErr); moved == warn {
+					t.Errorf("file moved = %v, want %v", moved, !warn)
+				}
+			})
+		}
+	}
+}
+
+func TestProcessFileHeader(t *testing.T) {
+	lines := append([]string{"dev_type\tdev_id\tlat\tlon\tapps"}, fixtureLines(4, 0)...)
+	path := writeGzip(t, "header.tsv.gz", lines...)
+	sink := newFakeSetter()
+	result, err := ProcessFile(context.Background(), path, testClients, testOptions(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != StatusOK || result.Empty || result.Processed != 4 || result.Errors != 0 {
+		t.Errorf("status %s, empty %v, processed %d, errors %d; want ok, false, 4, 0",
+			result.Status, result.Empty, result.Processed, result.Errors)
+	}
+	if sink.len() != 4 {
+		t.Errorf("sink has %d keys, want 4", sink.len())
+	}
+}
+
+func TestProcessFileDryRunKeepsName(t *testing.T) {
+	path := writeGzip(t, "dry.tsv.gz", fixtureLines(10, 0)...)
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.DryRun = true
+	result, err := ProcessFile(context.Background(), path, testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != 10 || result.DonePath != "" {
+		t.Errorf("processed %d, done path %q; want 10 and none", result.Processed, result.DonePath)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file moved by a dry run: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dry run left %d files in the directory, want only the input", len(entries))
+	}
+	if sink.callCount() != 0 {
+		t.Errorf("dry run wrote %d records", sink.callCount())
+	}
+}
+
+func TestProcessFileLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		truncated bool
+	}{
+		{"cut short", 4, true},
+		{"exactly the file", 10, false},
+		{"past the end", 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := fixtureLines(10, 0)
+			path := writeGzip(t, "limit.tsv.gz", lines...)
+			sink := newFakeSetter()
+			opts := testOptions(sink)
+			opts.Limit = tt.limit
+			result, err := ProcessFile(context.Background(), path, testClients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := min(tt.limit, len(lines))
+			if result.Status != StatusOK || result.Lines != want || result.Processed != want || result.Truncated != tt.truncated {
+				t.Errorf("status %s, lines %d, processed %d, truncated %v; want ok, %d, %d, %v",
+					result.Status, result.Lines, result.Processed, result.Truncated, want, want, tt.truncated)
+			}
+			for i, line := range lines {
+				record, _ := ParseAppsInstalled(line, ParseOptions{})
+				if _, ok := sink.value(record.DevType + ":" + record.DevID); ok != (i < want) {
+					t.Errorf("line %d written = %v, want %v", i+1, ok, i < want)
+				}
+			}
+			_, statErr := os.Stat(path)
+			if tt.truncated {
+				if result.DonePath != "" || statErr != nil {
+					t.Errorf("cut short file was marked done: done path %q, %v", result.DonePath, statErr)
+				}
+			} else if result.DonePath == "" || !os.IsNotExist(statErr) {
+				t.Errorf("file read in full was not marked done: done path %q, %v", result.DonePath, statErr)
+			}
+		})
+	}
+}
+
+func TestProcessReaderLongLine(t *testing.T) {
+	long := "idfa\tlong\t1\t2\t" + strings.Repeat("1,", 500)
+	tests := []struct {
+		name  string
+		lines []string
+	}{
+		{"middle", []string{"idfa\ta\t1\t2\t3", long, "idfa\tb\t1\t2\t3"}},
+		{"last without newline", []string{"idfa\ta\t1\t2\t3", "idfa\tb\t1\t2\t3", long}},
+		{"several", []string{long, "idfa\ta\t1\t2\t3", long, long, "idfa\tb\t1\t2\t3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := newFakeSetter()
+			opts := testOptions(sink)
+			opts.MaxLine = 100
+			opts.ErrRate = 1
+			input := strings.Join(tt.lines, "\n")
+			result, err := ProcessReader(context.Background(), "long", strings.NewReader(input), testClients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			longLines := strings.Count(input, long)
+			if result.Lines != len(tt.lines) || result.Processed != 2 || result.Errors != longLines {
+				t.Errorf("lines %d, processed %d, errors %d; want %d, 2, %d",
+					result.Lines, result.Processed, result.Errors, len(tt.lines), longLines)
+			}
+			for _, key := range []string{"idfa:a", "idfa:b"} {
+				if _, ok := sink.value(key); !ok {
+					t.Errorf("%s was not written", key)
+				}
+			}
+		})
+	}
+}
+
+// A line of exactly -max-line bytes is loaded, one byte more is not.
+func TestProcessReaderMaxLineBoundary(t *testing.T) {
+	const maxLine = 100
+	// The last app id is padded with zeros to the length wanted.
+	record := func(id string, length int) string {
+		line := "idfa\t" + id + "\t1\t2\t1"
+		line += strings.Repeat(",1", (length-len(line))/2)
+		return line + strings.Repeat("0", length-len(line))
+	}
+	exact, over := record("exact", maxLine), record("over", maxLine+1)
+	if len(exact) != maxLine || len(over) != maxLine+1 {
+		t.Fatalf("test lines of %d and %d bytes, want %d and %d", len(exact), len(over), maxLine, maxLine+1)
+	}
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.MaxLine = maxLine
+	opts.ErrRate = 1
+	result, err := ProcessReader(context.Background(), "boundary", strings.NewReader(exact+"\n"+over+"\n"+exact), testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != 2 || result.Errors != 1 {
+		t.Errorf("processed %d, errors %d; want 2 and 1", result.Processed, result.Errors)
+	}
+	if _, ok := sink.value("idfa:over"); ok {
+		t.Error("line over -max-line was written")
+	}
+}
+
+func TestProcessReaderRecordSep(t *testing.T) {
+	// The apps of the first record wrap over two lines and every record but
+	// the last ends with a newline after the separator.
+	input := "idfa\tdev1\t55.5\t42.4\t1,2,\n3,4\x1e\n" +
+		"gaid\tdev2\t1\t2\t5\n\x1e\n" +
+		"# a comment\nover two lines\x1e\n" +
+		"adid\tdev3\t1\t2\t6,\n7"
+	want := map[string][]uint32{"idfa:dev1": {1, 2, 3, 4}, "gaid:dev2": {5}, "adid:dev3": {6, 7}}
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.RecordSep = "\x1e"
+	result, err := ProcessReader(context.Background(), "records", strings.NewReader(input), testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lines != 4 || result.Processed != 3 || result.Errors != 0 {
+		t.Errorf("lines %d, processed %d, errors %d; want 4, 3, 0", result.Lines, result.Processed, result.Errors)
+	}
+	for key, apps := range want {
+		value, ok := sink.value(key)
+		if !ok {
+			t.Errorf("%s was not written", key)
+			continue
+		}
+		got, err := decodeRecord(value, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if !slices.Equal(got.Apps, apps) {
+			t.Errorf("%s apps %v, want %v", key, got.Apps, apps)
+		}
+	}
+
+	// Split on newlines, the wrapped records lose their second line, which
+	// fails to parse on its own.
+	sink = newFakeSetter()
+	opts = testOptions(sink)
+	opts.ErrRate = 1
+	result, err = ProcessReader(context.Background(), "lines", strings.NewReader(input), testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != 3 || result.Errors != 4 {
+		t.Errorf("split on newlines: processed %d, errors %d; want 3 and 4", result.Processed, result.Errors)
+	}
+	value, _ := sink.value("idfa:dev1")
+	if got, err := decodeRecord(value, opts); err != nil || !slices.Equal(got.Apps, []uint32{1, 2}) {
+		t.Errorf("split on newlines: idfa:dev1 = %+v, %v; want apps [1 2]", got, err)
+	}
+}
+
+func TestProcessReaderStrictUTF8(t *testing.T) {
+	input := "idfa\ta\t1\t2\t3\nidfa\tb\xff\t1\t2\t3\ngaid\tc\t1\t2\t3\n"
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			sink := newFakeSetter()
+			opts := testOptions(sink)
+			opts.ErrRate = 1
+			opts.Parse.StrictUTF8 = strict
+			result, err := ProcessReader(context.Background(), "utf8", strings.NewReader(input), testClients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantErrors := 0
+			if strict {
+				wantErrors = 1
+			}
+			if result.Processed != 3-wantErrors || result.Errors != wantErrors || result.Stats.ParseErrors != wantErrors {
+				t.Errorf("processed %d, errors %d, parse errors %d; want %d, %d, %d",
+					result.Processed, result.Errors, result.Stats.ParseErrors, 3-wantErrors, wantErrors, wantErrors)
+			}
+			if _, ok := sink.value("idfa:b\xff"); ok == strict {
+				t.Errorf("invalid key written = %v, want %v", ok, !strict)
+			}
+		})
+	}
+}
+
+// keysOf returns the keys of lines in order.
+func keysOf(lines []string) []string {
+	keys := make([]string, len(lines))
+	for i, line := range lines {
+		record, _ := ParseAppsInstalled(line, ParseOptions{})
+		keys[i] = record.DevType + ":" + record.DevID
+	}
+	return keys
+}
+
+// A single worker writes lines in input order: all of them with unbatched
+// writes, and those of each device type with one batch write at a time.
+func TestProcessReaderWriteOrder(t *testing.T) {
+	lines := fixtureLines(40, 0)
+	devTypeOf := func(key string) string { return key[:strings.IndexByte(key, ':')] }
+	for _, batch := range []int{1, 3} {
+		t.Run(fmt.Sprintf("batch=%d", batch), func(t *testing.T) {
+			sink := newFakeSetter()
+			opts := testOptions(sink)
+			opts.Workers = 1
+			opts.BatchSize = batch
+			opts.BatchConcurrency = 1
+			if _, err := ProcessReader(context.Background(), "order", strings.NewReader(strings.Join(lines, "\n")), testClients, opts); err != nil {
+				t.Fatal(err)
+			}
+			want := keysOf(lines)
+			got := sink.writes
+			if batch > 1 {
+				// Batches of different types are flushed as they fill, so only
+				// the order within each type is fixed.
+				perType := func(keys []string) map[string][]string {
+					m := make(map[string][]string)
+					for _, key := range keys {
+						m[devTypeOf(key)] = append(m[devTypeOf(key)], key)
+					}
+					return m
+				}
+				gotTypes, wantTypes := perType(got), perType(want)
+				for devType, keys := range wantTypes {
+					if !slices.Equal(gotTypes[devType], keys) {
+						t.Errorf("%s written as %q, want %q", devType, gotTypes[devType], keys)
+					}
+				}
+				return
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("written as %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// With -dedup, a single worker writes the kept records in the order of
+// their last occurrence.
+func TestProcessReaderDedupOrder(t *testing.T) {
+	lines := []string{
+		"idfa\ta\t1\t2\t1",
+		"gaid\tb\t1\t2\t1",
+		"idfa\ta\t1\t2\t2",
+		"adid\tc\t1\t2\t1",
+		"gaid\tb\t1\t2\t2",
+		"idfa\td\t1\t2\t1",
+	}
+	sink := newFakeSetter()
+	opts := testOptions(sink)
+	opts.Workers = 1
+	opts.Dedup = true
+	result, err := ProcessReader(context.Background(), "dedup", strings.NewReader(strings.Join(lines, "\n")), testClients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"idfa:a", "adid:c", "gaid:b", "idfa:d"}; !slices.Equal(sink.writes, want) {
+		t.Errorf("written as %q, want %q", sink.writes, want)
+	}
+	if result.Processed != 4 {
+		t.Errorf("processed %d, want 4", result.Processed)
+	}
+	for key, app := range map[string]uint32{"idfa:a": 2, "gaid:b": 2} {
+		value, _ := sink.value(key)
+		if got, err := decodeRecord(value, opts); err != nil || !slices.Equal(got.Apps, []uint32{app}) {
+			t.Errorf("%s = %+v, %v; want the last record", key, got, err)
+		}
+	}
+}
+
+// Only "BZh" followed by a block size digit is bzip2.
+func TestOpenInputBZhText(t *testing.T) {
+	for _, text := range []string{"BZh\tdev\t1\t2\t3\n", "BZhx\n", "BZh0\n", "BZh"} {
+		input, err := openInput(strings.NewReader(text), false)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		data, err := io.ReadAll(input)
+		if err != nil || string(data) != text {
+			t.Errorf("%q read as %q, %v", text, data, err)
+		}
+	}
+	input, err := openInput(strings.NewReader("BZh9 not really bzip2"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(input); !errors.Is(err, ErrDecompress) {
+		t.Errorf("bzip2 magic with garbage read without ErrDecompress: %v", err)
+	}
+}
+
+// gzipMember compresses text as one gzip member.
+func gzipMember(t *testing.T, text string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenInputGzipMembers(t *testing.T) {
+	first := gzipMember(t, "idfa\ta\t1\t2\t3\n")
+	second := gzipMember(t, strings.Repeat("gaid\tb\t1\t2\t3\n", 1000))
+	corrupt := bytes.Clone(second)
+	// Past the 10-byte header, in the deflate data.
+	for i := 10; i < 20; i++ {
+		corrupt[i] ^= 0xff
+	}
+	want := "idfa\ta\t1\t2\t3\n" + strings.Repeat("gaid\tb\t1\t2\t3\n", 1000)
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string
+		corrupt bool
+	}{
+		{"one member", first, "idfa\ta\t1\t2\t3\n", false},
+		{"two members", slices.Concat(first, second), want, false},
+		{"empty member between", slices.Concat(first, gzipMember(t, ""), second), want, false},
+		{"corrupt second member", slices.Concat(first, corrupt), "", true},
+		{"truncated second member", slices.Concat(first, second[:len(second)/2]), "", true},
+		{"trailing garbage", slices.Concat(first, second, []byte("not gzip")), "", true},
+	}
+	for _, tt := range tests {
+		for _, lowMem := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s lowmem=%v", tt.name, lowMem), func(t *testing.T) {
+				input, err := openInput(bytes.NewReader(tt.input), lowMem)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer input.Close()
+				data, err := io.ReadAll(input)
+				if tt.corrupt {
+					if !errors.Is(err, ErrDecompress) {
+						t.Errorf("err = %v, want ErrDecompress", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != tt.want {
+					t.Errorf("read %d bytes, want %d", len(data), len(tt.want))
+				}
+			})
+		}
+	}
+}
+
+func TestProcessFileCorruptMember(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corrupt.tsv.gz")
+	second := gzipMember(t, strings.Join(fixtureLines(100, 0), "\n"))
+	second = second[:len(second)/2]
+	if err := os.WriteFile(path, slices.Concat(gzipMember(t, strings.Join(fixtureLines(4, 0), "\n")+"\n"), second), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ProcessFile(context.Background(), path, testClients, testOptions(newFakeSetter()))
+	if !errors.Is(err, ErrDecompress) || !result.DecompressError {
+		t.Errorf("err = %v, decompress error %v; want ErrDecompress", err, result.DecompressError)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("corrupt file was moved: %v", err)
+	}
+}
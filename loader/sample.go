@@ -0,0 +1,13 @@
+package loader
+
+// keepLine reports whether line num is in a sample of the given rate. The
+// choice depends only on seed and the line number, so a sample is the same
+// across runs and worker counts.
+func keepLine(num int, rate float64, seed uint64) bool {
+	// splitmix64 of the seeded line number.
+	x := seed + uint64(num)*0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11)/(1<<53) < rate
+}
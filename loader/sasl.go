@@ -0,0 +1,302 @@
+package loader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Binary protocol opcodes and statuses used by saslConn.
+const (
+	binRequest  = 0x80
+	binResponse = 0x81
+
+	opGet      = 0x00
+	opSet      = 0x01
+	opAdd      = 0x02
+	opReplace  = 0x03
+	opDelete   = 0x04
+	opVersion  = 0x0b
+	opSASLAuth = 0x21
+
+	statusOK          = 0x0000
+	statusNotFound    = 0x0001
+	statusExists      = 0x0002
+	statusTooLarge    = 0x0003
+	statusNotStored   = 0x0005
+	statusOutOfMemory = 0x0082
+
+	binHeaderLen = 24
+)
+
+var crlf = []byte("\r\n")
+
+// SASLDialer returns a dial function for memcache.Client.DialContext that
+// authenticates every new connection with binary-protocol SASL PLAIN, as a
+// memcached started with -S requires. Such a server only speaks the binary
+// protocol, so the connection then turns the text commands gomemcache
+// writes into binary requests and their responses back into text replies.
+func SASLDialer(user, pass string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		nc, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			nc.SetDeadline(deadline)
+		}
+		c := &saslConn{Conn: nc, r: bufio.NewReader(nc)}
+		if err := c.auth(user, pass); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("memcached SASL auth at %s: %v", address, err)
+		}
+		nc.SetDeadline(time.Time{})
+		return c, nil
+	}
+}
+
+// saslConn runs each complete text command written to it as a binary
+// request and buffers the text reply for the following reads. gomemcache
+// writes a whole command and flushes before it reads the reply, so the
+// binary round trip happens within the deadline it set for the command.
+type saslConn struct {
+	net.Conn
+	r   *bufio.Reader
+	in  bytes.Buffer
+	out bytes.Buffer
+}
+
+type binResponseMsg struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	value  []byte
+}
+
+func (c *saslConn) auth(user, pass string) error {
+	resp, err := c.roundTrip(opSASLAuth, nil, []byte("PLAIN"), []byte("\x00"+user+"\x00"+pass), 0)
+	if err != nil {
+		return err
+	}
+	if resp.status != statusOK {
+		return fmt.Errorf("server replied status %#x: %s", resp.status, resp.value)
+	}
+	return nil
+}
+
+func (c *saslConn) roundTrip(op byte, extras, key, value []byte, cas uint64) (*binResponseMsg, error) {
+	req := make([]byte, binHeaderLen, binHeaderLen+len(extras)+len(key)+len(value))
+	req[0] = binRequest
+	req[1] = op
+	binary.BigEndian.PutUint16(req[2:], uint16(len(key)))
+	req[4] = byte(len(extras))
+	binary.BigEndian.PutUint32(req[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(req[16:], cas)
+	req = append(append(append(req, extras...), key...), value...)
+	if _, err := c.Conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var header [binHeaderLen]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != binResponse || header[1] != op {
+		return nil, fmt.Errorf("unexpected binary response header %x", header[:2])
+	}
+	keyLen := int(binary.BigEndian.Uint16(header[2:]))
+	extrasLen := int(header[4])
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	if extrasLen+keyLen > len(body) {
+		return nil, fmt.Errorf("corrupt binary response body")
+	}
+	return &binResponseMsg{
+		status: binary.BigEndian.Uint16(header[6:]),
+		cas:    binary.BigEndian.Uint64(header[16:]),
+		extras: body[:extrasLen],
+		value:  body[extrasLen+keyLen:],
+	}, nil
+}
+
+func (c *saslConn) Write(p []byte) (int, error) {
+	c.in.Write(p)
+	for {
+		done, err := c.runCommand()
+		if err != nil {
+			return len(p), err
+		}
+		if !done {
+			return len(p), nil
+		}
+	}
+}
+
+func (c *saslConn) Read(p []byte) (int, error) {
+	if c.out.Len() == 0 {
+		return 0, errors.New("memcache: read with no command pending on SASL connection")
+	}
+	return c.out.Read(p)
+}
+
+// runCommand runs the first command buffered in c.in if it is complete and
+// reports whether it did.
+func (c *saslConn) runCommand() (bool, error) {
+	data := c.in.Bytes()
+	end := bytes.Index(data, crlf)
+	if end < 0 {
+		return false, nil
+	}
+	fields := strings.Fields(string(data[:end]))
+	if len(fields) == 0 {
+		c.in.Next(end + len(crlf))
+		return true, nil
+	}
+	switch verb := fields[0]; verb {
+	case "set", "add", "replace", "cas":
+		return c.store(verb, fields, data[end+len(crlf):], end+len(crlf))
+	case "get", "gets":
+		c.in.Next(end + len(crlf))
+		return true, c.get(fields[1:])
+	case "delete":
+		c.in.Next(end + len(crlf))
+		if len(fields) != 2 {
+			c.out.WriteString("ERROR\r\n")
+			return true, nil
+		}
+		resp, err := c.roundTrip(opDelete, nil, []byte(fields[1]), nil, 0)
+		if err != nil {
+			return true, err
+		}
+		switch resp.status {
+		case statusOK:
+			c.out.WriteString("DELETED\r\n")
+		case statusNotFound:
+			c.out.WriteString("NOT_FOUND\r\n")
+		default:
+			c.serverError(resp)
+		}
+		return true, nil
+	case "version":
+		c.in.Next(end + len(crlf))
+		resp, err := c.roundTrip(opVersion, nil, nil, nil, 0)
+		if err != nil {
+			return true, err
+		}
+		if resp.status != statusOK {
+			c.serverError(resp)
+			return true, nil
+		}
+		fmt.Fprintf(&c.out, "VERSION %s\r\n", resp.value)
+		return true, nil
+	default:
+		// Only the commands the loader uses are translated.
+		c.in.Next(end + len(crlf))
+		c.out.WriteString("ERROR\r\n")
+		return true, nil
+	}
+}
+
+// store runs "<verb> <key> <flags> <exptime> <bytes> [<cas>]" once its data
+// block has been written too.
+func (c *saslConn) store(verb string, fields []string, rest []byte, lineLen int) (bool, error) {
+	if len(fields) < 5 || (verb == "cas") != (len(fields) == 6) {
+		return true, fmt.Errorf("memcache: malformed %s command on SASL connection", verb)
+	}
+	size, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return true, fmt.Errorf("memcache: malformed %s command on SASL connection", verb)
+	}
+	if len(rest) < size+len(crlf) {
+		return false, nil
+	}
+	flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+	exp, err2 := strconv.ParseInt(fields[3], 10, 32)
+	var cas uint64
+	var err3 error
+	if verb == "cas" {
+		cas, err3 = strconv.ParseUint(fields[5], 10, 64)
+	}
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return true, fmt.Errorf("memcache: malformed %s command on SASL connection: %v", verb, err)
+	}
+	value := bytes.Clone(rest[:size])
+	c.in.Next(lineLen + size + len(crlf))
+
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, uint32(flags))
+	binary.BigEndian.PutUint32(extras[4:], uint32(exp))
+	op := byte(opSet)
+	switch verb {
+	case "add":
+		op = opAdd
+	case "replace":
+		op = opReplace
+	}
+	resp, err := c.roundTrip(op, extras, []byte(fields[1]), value, cas)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case resp.status == statusOK:
+		c.out.WriteString("STORED\r\n")
+	case resp.status == statusNotFound && verb == "cas":
+		c.out.WriteString("NOT_FOUND\r\n")
+	case resp.status == statusExists && verb == "cas":
+		c.out.WriteString("EXISTS\r\n")
+	case resp.status == statusNotFound, resp.status == statusExists, resp.status == statusNotStored:
+		c.out.WriteString("NOT_STORED\r\n")
+	default:
+		c.serverError(resp)
+	}
+	return true, nil
+}
+
+func (c *saslConn) get(keys []string) error {
+	for _, key := range keys {
+		resp, err := c.roundTrip(opGet, nil, []byte(key), nil, 0)
+		if err != nil {
+			return err
+		}
+		switch resp.status {
+		case statusOK:
+			var flags uint32
+			if len(resp.extras) >= 4 {
+				flags = binary.BigEndian.Uint32(resp.extras)
+			}
+			fmt.Fprintf(&c.out, "VALUE %s %d %d %d\r\n", key, flags, len(resp.value), resp.cas)
+			c.out.Write(resp.value)
+			c.out.Write(crlf)
+		case statusNotFound:
+		default:
+			c.serverError(resp)
+			return nil
+		}
+	}
+	c.out.WriteString("END\r\n")
+	return nil
+}
+
+// serverError replies with the text protocol's wording for the statuses
+// isTransient and tooLargeError look for.
+func (c *saslConn) serverError(resp *binResponseMsg) {
+	switch resp.status {
+	case statusTooLarge:
+		c.out.WriteString("SERVER_ERROR object too large for cache\r\n")
+	case statusOutOfMemory:
+		c.out.WriteString("SERVER_ERROR out of memory storing object\r\n")
+	default:
+		fmt.Fprintf(&c.out, "SERVER_ERROR status %#x: %s\r\n", resp.status, resp.value)
+	}
+}
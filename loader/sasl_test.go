@@ -0,0 +1,299 @@
+package loader
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// binaryServer is a memcached that, like one started with -S, speaks only
+// the binary protocol and requires SASL PLAIN before anything else.
+type binaryServer struct {
+	user, pass string
+	maxValue   int
+
+	mu    sync.Mutex
+	items map[string]binaryItem
+	cas   uint64
+}
+
+type binaryItem struct {
+	flags []byte
+	value []byte
+	cas   uint64
+}
+
+func startBinaryServer(t *testing.T, user, pass string, maxValue int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &binaryServer{user: user, pass: pass, maxValue: maxValue, items: make(map[string]binaryItem)}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *binaryServer) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	authed := false
+	for {
+		var header [binHeaderLen]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		if header[0] != binRequest {
+			// A text command: a SASL server drops the connection.
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		op := header[1]
+		extrasLen := int(header[4])
+		keyLen := int(binary.BigEndian.Uint16(header[2:]))
+		extras, key, value := body[:extrasLen], string(body[extrasLen:extrasLen+keyLen]), body[extrasLen+keyLen:]
+		cas := binary.BigEndian.Uint64(header[16:])
+
+		var status uint16
+		var respExtras, respValue []byte
+		var respCAS uint64
+		switch {
+		case op == opSASLAuth:
+			if key == "PLAIN" && string(value) == "\x00"+s.user+"\x00"+s.pass {
+				authed = true
+			} else {
+				status, respValue = 0x20, []byte("Auth failure")
+			}
+		case !authed:
+			status, respValue = 0x20, []byte("Auth failure")
+		default:
+			status, respExtras, respValue, respCAS = s.handle(op, extras, key, value, cas)
+		}
+
+		resp := make([]byte, binHeaderLen)
+		resp[0] = binResponse
+		resp[1] = op
+		resp[4] = byte(len(respExtras))
+		binary.BigEndian.PutUint16(resp[6:], status)
+		binary.BigEndian.PutUint32(resp[8:], uint32(len(respExtras)+len(respValue)))
+		binary.BigEndian.PutUint64(resp[16:], respCAS)
+		resp = append(append(resp, respExtras...), respValue...)
+		if _, err := nc.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *binaryServer) handle(op byte, extras []byte, key string, value []byte, cas uint64) (uint16, []byte, []byte, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, found := s.items[key]
+	switch op {
+	case opGet:
+		if !found {
+			return statusNotFound, nil, nil, 0
+		}
+		return statusOK, item.flags, item.value, item.cas
+	case opSet, opAdd, opReplace:
+		switch {
+		case len(value) > s.maxValue:
+			return statusTooLarge, nil, []byte("Too large."), 0
+		case op == opAdd && found:
+			return statusExists, nil, nil, 0
+		case op == opReplace && !found:
+			return statusNotFound, nil, nil, 0
+		case cas != 0 && !found:
+			return statusNotFound, nil, nil, 0
+		case cas != 0 && cas != item.cas:
+			return statusExists, nil, nil, 0
+		}
+		s.cas++
+		s.items[key] = binaryItem{flags: extras[:4], value: value, cas: s.cas}
+		return statusOK, nil, nil, s.cas
+	case opDelete:
+		if !found {
+			return statusNotFound, nil, nil, 0
+		}
+		delete(s.items, key)
+		return statusOK, nil, nil, 0
+	case opVersion:
+		return statusOK, nil, []byte("1.6.21"), 0
+	}
+	return 0x81, nil, []byte("Unknown command"), 0
+}
+
+func saslClient(addr, user, pass string) *memcache.Client {
+	mc := memcache.New(addr)
+	mc.DialContext = SASLDialer(user, pass)
+	return mc
+}
+
+func TestSASLDialer(t *testing.T) {
+	addr := startBinaryServer(t, "loader", "secret", 1024)
+	mc := saslClient(addr, "loader", "secret")
+
+	if err := mc.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := checkBackend(mc); err != nil {
+		t.Fatalf("health check: %v", err)
+	}
+	if _, err := mc.Get("idfa:1"); !errors.Is(err, memcache.ErrCacheMiss) {
+		t.Errorf("get of a missing key: %v, want ErrCacheMiss", err)
+	}
+	if err := mc.Set(&memcache.Item{Key: "idfa:1", Value: []byte("v1"), Flags: 7}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	item, err := mc.Get("idfa:1")
+	if err != nil || string(item.Value) != "v1" || item.Flags != 7 {
+		t.Fatalf("get = %+v, %v; want v1 with flags 7", item, err)
+	}
+	if err := mc.Add(&memcache.Item{Key: "idfa:1", Value: []byte("v2")}); !errors.Is(err, memcache.ErrNotStored) {
+		t.Errorf("add of an existing key: %v, want ErrNotStored", err)
+	}
+
+	// A swap after another writer changed the key conflicts.
+	item.Value = []byte("v3")
+	if err := mc.Set(&memcache.Item{Key: "idfa:1", Value: []byte("other")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.CompareAndSwap(item); !errors.Is(err, memcache.ErrCASConflict) {
+		t.Errorf("stale compare-and-swap: %v, want ErrCASConflict", err)
+	}
+	item, err = mc.Get("idfa:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Value = []byte("v3")
+	if err := mc.CompareAndSwap(item); err != nil {
+		t.Errorf("compare-and-swap: %v", err)
+	}
+	if item, err := mc.Get("idfa:1"); err != nil || string(item.Value) != "v3" {
+		t.Errorf("get after swap = %+v, %v; want v3", item, err)
+	}
+
+	// setWithRetry still tells a too large value from a transient error.
+	big := &memcache.Item{Key: "idfa:big", Value: []byte(strings.Repeat("x", 2048))}
+	if err := setWithRetry(context.Background(), mc, big, Options{Retries: 3}); !errors.Is(err, ErrItemTooLarge) {
+		t.Errorf("set of a too large value: %v, want ErrItemTooLarge", err)
+	}
+	if err := mc.Delete("idfa:1"); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+	if err := mc.Delete("idfa:1"); !errors.Is(err, memcache.ErrCacheMiss) {
+		t.Errorf("delete of a missing key: %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestSASLDialerWrongPassword(t *testing.T) {
+	addr := startBinaryServer(t, "loader", "secret", 1024)
+	if err := checkBackend(saslClient(addr, "loader", "wrong")); err == nil || !strings.Contains(err.Error(), "SASL auth") {
+		t.Errorf("health check with a wrong password: %v, want a SASL auth error", err)
+	}
+	// The text protocol gets nowhere with a SASL server.
+	mc := memcache.New(addr)
+	if err := mc.Ping(); err == nil {
+		t.Error("text-protocol ping of a SASL server succeeded")
+	}
+}
+
+func TestProcessFileSASL(t *testing.T) {
+	addr := startBinaryServer(t, "loader", "secret", 1024)
+	mc := saslClient(addr, "loader", "secret")
+	clients := make(map[string]*memcache.Client, len(testClients))
+	for devType := range testClients {
+		clients[devType] = mc
+	}
+	lines := fixtureLines(20, 0)
+	path := writeGzip(t, "sasl.tsv.gz", lines...)
+	opts := testOptions(nil)
+	opts.BatchSize = 4
+	result, err := ProcessFile(context.Background(), path, clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != len(lines) || result.Errors != 0 {
+		t.Errorf("processed %d, errors %d; want %d and 0", result.Processed, result.Errors, len(lines))
+	}
+	for _, key := range keysOf(lines) {
+		if _, err := mc.Get(key); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+// With CAS, the last line of a key wins whichever worker writes it first,
+// and a file loaded later wins over any line of an earlier one.
+func TestProcessFileCAS(t *testing.T) {
+	addr := startBinaryServer(t, "loader", "secret", 1024)
+	mc := saslClient(addr, "loader", "secret")
+	clients := map[string]*memcache.Client{"idfa": mc}
+	opts := testOptions(nil)
+	opts.Workers = 8
+	opts.CAS = true
+	stored := func() (ValueHeader, []uint32) {
+		t.Helper()
+		item, err := mc.Get("idfa:dev1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _, err := DecodeHeader(item.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := decodeRecord(item.Value, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return header, record.Apps
+	}
+
+	var lines []string
+	for i := range 200 {
+		lines = append(lines, fmt.Sprintf("idfa\tdev1\t1\t2\t%d", i))
+	}
+	result, err := ProcessFile(context.Background(), writeGzip(t, "first.tsv.gz", lines...), clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Errors != 0 || result.Processed+result.SkippedExisting != len(lines) {
+		t.Errorf("processed %d, skipped %d, errors %d; want %d written or skipped", result.Processed, result.SkippedExisting, result.Errors, len(lines))
+	}
+	header, apps := stored()
+	if header.Version != HeaderVersionOrdered || header.Order.Line != 199 || !slices.Equal(apps, []uint32{199}) {
+		t.Errorf("stored %+v with apps %v, want the last line 199", header, apps)
+	}
+
+	result, err = ProcessFile(context.Background(), writeGzip(t, "second.tsv.gz", "idfa\tdev1\t1\t2\t7"), clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Processed != 1 {
+		t.Errorf("second file processed %d, skipped %d; want 1", result.Processed, result.SkippedExisting)
+	}
+	if _, apps := stored(); !slices.Equal(apps, []uint32{7}) {
+		t.Errorf("stored apps %v after a later file, want [7]", apps)
+	}
+}
@@ -0,0 +1,39 @@
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Serializer encodes the value stored under a record's key. The key layout
+// doesn't depend on it.
+type Serializer interface {
+	Serialize(apps AppsInstalled) ([]byte, error)
+}
+
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) Serialize(apps AppsInstalled) ([]byte, error) {
+	return SerializeAppsInstalled(apps)
+}
+
+// JSONSerializer writes the same fields as the UserApps message.
+type JSONSerializer struct{}
+
+func (JSONSerializer) Serialize(apps AppsInstalled) ([]byte, error) {
+	return json.Marshal(struct {
+		Lat  float64  `json:"lat"`
+		Lon  float64  `json:"lon"`
+		Apps []uint32 `json:"apps"`
+	}{apps.Lat, apps.Lon, apps.Apps})
+}
+
+func NewSerializer(format string) (Serializer, error) {
+	switch format {
+	case "protobuf":
+		return ProtobufSerializer{}, nil
+	case "json":
+		return JSONSerializer{}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want protobuf or json", format)
+}
@@ -0,0 +1,82 @@
+package loader
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"go_multithreading/appsinstalled"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSerializeAppsInstalled(t *testing.T) {
+	tests := []AppsInstalled{
+		{DevType: "idfa", DevID: "1rfw", Lat: 55.55, Lon: 42.42, Apps: []uint32{1423, 43, 567, 3, 7, 23}},
+		{DevType: "gaid", DevID: "7rfw", Lat: -90, Lon: 180},
+		{DevType: "adid", DevID: "x", Lat: 0, Lon: 0, Apps: []uint32{0, 1 << 31}},
+	}
+	for _, apps := range tests {
+		data, err := SerializeAppsInstalled(apps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ua appsinstalled.UserApps
+		if err := proto.Unmarshal(data, &ua); err != nil {
+			t.Fatal(err)
+		}
+		if ua.GetLat() != apps.Lat || ua.GetLon() != apps.Lon || !slices.Equal(ua.GetApps(), apps.Apps) {
+			t.Errorf("%+v round-tripped to lat %v, lon %v, apps %v", apps, ua.GetLat(), ua.GetLon(), ua.GetApps())
+		}
+		// The pooled buffer is reused, so an earlier result must not change.
+		again, _ := SerializeAppsInstalled(AppsInstalled{Lat: 1, Lon: 2, Apps: []uint32{9}})
+		if slices.Equal(data, again) {
+			t.Errorf("%+v serialized like a different record", apps)
+		}
+		if err := proto.Unmarshal(data, &ua); err != nil || ua.GetLat() != apps.Lat {
+			t.Errorf("serialized %+v changed after another record", apps)
+		}
+	}
+}
+
+func TestEncodeRecordFormats(t *testing.T) {
+	apps := AppsInstalled{DevType: "idfa", DevID: "1rfw", Lat: 55.55, Lon: 42.42, Apps: []uint32{1, 2, 3}}
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"protobuf", Options{}},
+		{"json", Options{Serializer: JSONSerializer{}}},
+		{"compressed", Options{CompressValues: true, CompressThreshold: 1}},
+		{"compressed below threshold", Options{CompressValues: true, CompressThreshold: DefaultCompressThreshold}},
+		{"header", Options{WithHeader: true, Serializer: JSONSerializer{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encodeRecord(apps, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeRecord(data, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Lat != apps.Lat || got.Lon != apps.Lon || !slices.Equal(got.Apps, apps.Apps) {
+				t.Errorf("decoded %+v, want %+v", got, apps)
+			}
+		})
+	}
+}
+
+func TestJSONSerializer(t *testing.T) {
+	data, err := JSONSerializer{}.Serialize(AppsInstalled{DevType: "idfa", DevID: "1", Lat: 1.5, Lon: -2, Apps: []uint32{7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got["lat"] != 1.5 || got["lon"] != -2.0 {
+		t.Errorf("got %s, want only lat, lon and apps", data)
+	}
+}
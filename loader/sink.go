@@ -0,0 +1,154 @@
+package loader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Sink is a destination for serialized records: the per device type
+// memcached servers through memcacheSink, which is used unless
+// Options.Sink is set, or a FileSink.
+type Sink interface {
+	Write(devType string, item *memcache.Item) error
+}
+
+// sinkSetter is the Setter the write path, with its retries and batches,
+// hands the records of one device type to. Whether add mode only adds is up
+// to the sink, so Add writes like Set.
+type sinkSetter struct {
+	sink    Sink
+	devType string
+}
+
+func (s sinkSetter) Set(item *memcache.Item) error {
+	return s.sink.Write(s.devType, item)
+}
+
+func (s sinkSetter) Add(item *memcache.Item) error {
+	return s.sink.Write(s.devType, item)
+}
+
+// memcacheSink writes every record to the memcached of its device type
+// through that type's setters: the read-modify-write of merge mode or of
+// set mode with CAS, the Set
+// latency timing and the circuit breaker. In add mode it only adds, so a
+// key that exists fails with memcache.ErrNotStored.
+type memcacheSink struct {
+	setters map[string]Setter
+	add     bool
+}
+
+func newMemcacheSink(mcClients map[string]*memcache.Client, opts Options, stats *Stats) *memcacheSink {
+	s := &memcacheSink{setters: make(map[string]Setter, len(mcClients)), add: opts.Mode == ModeAdd}
+	for devType, client := range mcClients {
+		var mc Setter = client
+		switch {
+		case opts.Mode == ModeMerge:
+			mc = newMergeSetter(client, opts)
+		case opts.CAS:
+			mc = newOrderedSetter(client)
+		}
+		mc = timedSetter{mc, devType, stats}
+		if b := opts.Breakers[devType]; b != nil {
+			mc = breakerSetter{mc, b}
+		}
+		s.setters[devType] = mc
+	}
+	return s
+}
+
+func (s *memcacheSink) Write(devType string, item *memcache.Item) error {
+	mc, ok := s.setters[devType]
+	if !ok {
+		return fmt.Errorf("no memcached for device type %s", devType)
+	}
+	if s.add {
+		return mc.Add(item)
+	}
+	return mc.Set(item)
+}
+
+// FileSink appends records to a file as a big-endian uint32 key length, the
+// key, a uint32 value length and the value. FileSinkReader reads them back.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+}
+
+func CreateFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// Write appends item's key and value; add mode and expiration don't apply
+// to a file.
+func (s *FileSink) Write(devType string, item *memcache.Item) error {
+	key, value := item.Key, item.Value
+	var header [4]byte
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	binary.BigEndian.PutUint32(header[:], uint32(len(key)))
+	s.w.Write(header[:])
+	s.w.WriteString(key)
+	binary.BigEndian.PutUint32(header[:], uint32(len(value)))
+	s.w.Write(header[:])
+	_, err := s.w.Write(value)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+type FileSinkReader struct {
+	r *bufio.Reader
+}
+
+func NewFileSinkReader(r io.Reader) *FileSinkReader {
+	return &FileSinkReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (r *FileSinkReader) Next() (key string, value []byte, err error) {
+	k, err := r.field()
+	if err != nil {
+		return "", nil, err
+	}
+	value, err = r.field()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return string(k), value, err
+}
+
+func (r *FileSinkReader) field() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("truncated record: %w", err)
+	}
+	return data, nil
+}
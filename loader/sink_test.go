@@ -0,0 +1,91 @@
+package loader
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestMemcacheSink(t *testing.T) {
+	addr := startBinaryServer(t, "loader", "secret", 1024)
+	mc := saslClient(addr, "loader", "secret")
+	clients := map[string]*memcache.Client{"idfa": mc}
+	encode := func(apps ...uint32) []byte {
+		value, err := encodeRecord(AppsInstalled{Lat: 1, Lon: 2, Apps: apps}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	stored := func(key string) []uint32 {
+		t.Helper()
+		item, err := mc.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		record, err := decodeRecord(item.Value, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record.Apps
+	}
+
+	tests := []struct {
+		mode       string
+		secondErr  error
+		wantStored []uint32
+	}{
+		{ModeSet, nil, []uint32{2}},
+		{ModeAdd, memcache.ErrNotStored, []uint32{1}},
+		{ModeMerge, nil, []uint32{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			stats := &Stats{}
+			sink := newMemcacheSink(clients, Options{Mode: tt.mode}, stats)
+			key := "idfa:" + tt.mode
+			if err := sink.Write("idfa", &memcache.Item{Key: key, Value: encode(1)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Write("idfa", &memcache.Item{Key: key, Value: encode(2)}); !errors.Is(err, tt.secondErr) {
+				t.Errorf("second write: %v, want %v", err, tt.secondErr)
+			}
+			if got := stored(key); !slices.Equal(got, tt.wantStored) {
+				t.Errorf("stored apps %v, want %v", got, tt.wantStored)
+			}
+			calls := 0
+			for _, n := range stats.ByType["idfa"].SetLatency {
+				calls += n
+			}
+			if calls != 2 {
+				t.Errorf("%d writes timed, want 2", calls)
+			}
+		})
+	}
+
+	sink := newMemcacheSink(clients, Options{}, &Stats{})
+	if err := sink.Write("gaid", &memcache.Item{Key: "gaid:1", Value: encode(1)}); err == nil {
+		t.Error("write of a device type without memcached succeeded")
+	}
+
+	// A backend that refuses connections opens its breaker.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+	opts := Options{Breakers: map[string]*CircuitBreaker{"gaid": NewCircuitBreaker("gaid", 1, time.Minute)}}
+	sink = newMemcacheSink(map[string]*memcache.Client{"gaid": memcache.New(down)}, opts, &Stats{})
+	item := &memcache.Item{Key: "gaid:1", Value: encode(1)}
+	if err := sink.Write("gaid", item); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("first write to a down backend: %v, want its connection error", err)
+	}
+	if err := sink.Write("gaid", item); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("second write to a down backend: %v, want ErrCircuitOpen", err)
+	}
+}
@@ -0,0 +1,45 @@
+package loader
+
+import "bytes"
+
+// lineSplitter is bufio.ScanLines with a length limit that skips an overlong
+// line instead of failing the whole input with bufio.ErrTooLong. The skipped
+// line comes out as an empty token with tooLong set, so it still takes up a
+// line number. Lines of up to max bytes are kept, so the scanner buffer
+// needs room for max bytes and the separator. Records end with sep, newline by default, so with another
+// separator a record may contain newlines.
+type lineSplitter struct {
+	max      int
+	sep      byte
+	skipping bool
+	tooLong  bool
+}
+
+func (s *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	s.tooLong = false
+	if i := bytes.IndexByte(data, s.sep); i >= 0 {
+		if s.skipping {
+			s.skipping = false
+			s.tooLong = true
+			return i + 1, []byte{}, nil
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		if s.skipping {
+			s.skipping = false
+			s.tooLong = true
+			return len(data), []byte{}, nil
+		}
+		if len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	// More than max bytes without a separator is a line over the limit.
+	if s.skipping || len(data) > s.max {
+		s.skipping = true
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,48 @@
+package loader
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestLineSplitter(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		sep   byte
+		max   int
+		want  []string
+	}{
+		{"newline", "a\nb\n", '\n', 10, []string{"a", "b"}},
+		{"last without separator", "a\nb", '\n', 10, []string{"a", "b"}},
+		{"record separator", "a\nb\x1ec\n\x1ed", 0x1e, 10, []string{"a\nb", "c\n", "d"}},
+		{"newlines only", "\n\n", 0x1e, 10, []string{"\n\n"}},
+		// Overlong records come out empty, so they keep their number.
+		{"too long", "abcdefghijkl\x1ea\x1e", 0x1e, 4, []string{"", "a"}},
+		{"too long last", "a\x1eabcdefghijkl", 0x1e, 4, []string{"a", ""}},
+		{"exactly max", "abcd\x1eabcde\x1eabcd", 0x1e, 4, []string{"abcd", "", "abcd"}},
+		{"exactly max newline", "abcd\nabcde\n", '\n', 4, []string{"abcd", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			splitter := &lineSplitter{max: tt.max, sep: tt.sep}
+			// One byte per read, so every record crosses scanner reads.
+			scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(tt.input)))
+			scanner.Buffer(make([]byte, 0, 4), tt.max+1)
+			scanner.Split(splitter.split)
+			var got []string
+			for scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("records %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
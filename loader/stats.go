@@ -0,0 +1,388 @@
+package loader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+type TypeStats struct {
+	Processed int
+	Errors    int
+	Bytes     int
+	// SetLatency counts memcached writes by duration, see LatencyBucketNames.
+	SetLatency [NumLatencyBuckets]int
+}
+
+const (
+	StatusOK            = "ok"
+	StatusHighErrorRate = "high_error_rate"
+	StatusFailed        = "failed"
+	StatusInterrupted   = "interrupted"
+	// StatusSkipped is set by the caller on inputs it cut short itself, such
+	// as the files in flight when -fail-fast stops a run.
+	StatusSkipped = "skipped"
+	// StatusEmpty is set instead of StatusOK for inputs without records when
+	// Options.WarnEmpty is set.
+	StatusEmpty = "empty"
+)
+
+// Result is the outcome of loading one input. Stats holds the full counters
+// of that input so the caller can sum them across files.
+type Result struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	Lines           int     `json:"lines"`
+	Processed       int     `json:"processed"`
+	Errors          int     `json:"errors"`
+	ErrRate         float64 `json:"err_rate"`
+	VerifyFailures  int     `json:"verify_failures,omitempty"`
+	SkippedExisting int     `json:"skipped_existing,omitempty"`
+	DiffNew         int     `json:"diff_new,omitempty"`
+	DiffChanged     int     `json:"diff_changed,omitempty"`
+	DiffUnchanged   int     `json:"diff_unchanged,omitempty"`
+	TooLarge        int     `json:"too_large,omitempty"`
+	ElapsedSeconds  float64 `json:"elapsed_seconds"`
+	LinesPerSec     float64 `json:"lines_per_sec"`
+	Truncated       bool    `json:"truncated,omitempty"`
+	Empty           bool    `json:"empty,omitempty"`
+	DecompressError bool    `json:"decompress_error,omitempty"`
+	DonePath        string  `json:"done_path,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	Stats           *Stats  `json:"-"`
+}
+
+func (r *Result) finish(start time.Time, err error) {
+	elapsed := time.Since(start)
+	r.ElapsedSeconds = elapsed.Seconds()
+	if r.ElapsedSeconds > 0 {
+		r.LinesPerSec = float64(r.Lines) / r.ElapsedSeconds
+	}
+	newLogger(r.Name).Info("File done", "elapsed", elapsed.String(), "lines", r.Lines, "lines_per_sec", r.LinesPerSec)
+	if r.Stats == nil {
+		r.Stats = &Stats{}
+	}
+	if err != nil {
+		r.Error = err.Error()
+		r.DecompressError = errors.Is(err, ErrDecompress)
+		if r.Status != StatusInterrupted {
+			r.Status = StatusFailed
+		}
+	}
+}
+
+type Stats struct {
+	Processed   int
+	Errors      int
+	ParseErrors int
+	// TooFewApps and TooManyApps are the parse errors of records outside
+	// the -min-apps/-max-apps bounds.
+	TooFewApps  int
+	TooManyApps int
+	// VerifyFailures are sampled items that were missing or differed when
+	// read back; they are not included in Errors.
+	VerifyFailures int
+	// SkippedExisting are keys not written in add mode because they were
+	// already present.
+	SkippedExisting int
+	// SampledOut are lines left out by Options.SampleRate; they are neither
+	// processed nor errors.
+	SampledOut int
+	// FilteredOut are records skipped by Options.Filter.
+	FilteredOut int
+	// DiffNew, DiffChanged and DiffUnchanged count the records of a
+	// Options.Diff run by how they compare to the stored values.
+	DiffNew       int
+	DiffChanged   int
+	DiffUnchanged int
+	// TooLarge are items memcached rejected for their size,
+	// TooLargeTruncated those of them then written with fewer apps.
+	TooLarge          int
+	TooLargeTruncated int
+	UnknownTypes      map[string]int
+	ByType            map[string]*TypeStats
+	mu                sync.Mutex
+	live              *liveCounts
+	// largest holds the Options.TopSizes largest serialized records.
+	largest *topSizes
+}
+
+// Workers count into their own Stats and merge them once they finish, so
+// progress reports read these shared atomics instead.
+type liveCounts struct {
+	processed atomic.Int64
+	errors    atomic.Int64
+}
+
+func (s *Stats) workerStats() *Stats {
+	return &Stats{live: s.live}
+}
+
+func (s *Stats) typeStats(devType string) *TypeStats {
+	if s.ByType == nil {
+		s.ByType = make(map[string]*TypeStats)
+	}
+	ts, ok := s.ByType[devType]
+	if !ok {
+		ts = &TypeStats{}
+		s.ByType[devType] = ts
+	}
+	return ts
+}
+
+func (s *Stats) addProcessed(devType string, n int) {
+	s.mu.Lock()
+	s.Processed += n
+	s.typeStats(devType).Processed += n
+	s.mu.Unlock()
+	if s.live != nil {
+		s.live.processed.Add(int64(n))
+	}
+	processedTotal.Add(float64(n))
+	processedByType.WithLabelValues(devType).Add(float64(n))
+}
+
+// writeCounts are the outcomes of writes to one device type, such as the
+// items of a batch, added to Stats at once by addWrites.
+type writeCounts struct {
+	processed, errors, skipped, bytes int
+}
+
+// addWrites counts c with a single update of the shared counters, instead
+// of one per record.
+func (s *Stats) addWrites(devType string, c writeCounts) {
+	s.mu.Lock()
+	s.Processed += c.processed
+	s.Errors += c.errors
+	s.SkippedExisting += c.skipped
+	ts := s.typeStats(devType)
+	ts.Processed += c.processed
+	ts.Errors += c.errors
+	ts.Bytes += c.bytes
+	s.mu.Unlock()
+	if s.live != nil {
+		if c.processed > 0 {
+			s.live.processed.Add(int64(c.processed))
+		}
+		if c.errors > 0 {
+			s.live.errors.Add(int64(c.errors))
+		}
+	}
+	if c.processed > 0 {
+		processedTotal.Add(float64(c.processed))
+		processedByType.WithLabelValues(devType).Add(float64(c.processed))
+	}
+	if c.errors > 0 {
+		errorsTotal.Add(float64(c.errors))
+	}
+}
+
+func (s *Stats) addBytes(devType string, n int) {
+	s.mu.Lock()
+	s.typeStats(devType).Bytes += n
+	s.mu.Unlock()
+}
+
+func (s *Stats) addLatency(devType string, d time.Duration) {
+	s.mu.Lock()
+	s.typeStats(devType).SetLatency[latencyBucket(d)]++
+	s.mu.Unlock()
+	setLatency.WithLabelValues(devType).Observe(d.Seconds())
+}
+
+func (s *Stats) addErrors(devType string, n int) {
+	s.mu.Lock()
+	s.Errors += n
+	if devType != "" {
+		s.typeStats(devType).Errors += n
+	}
+	s.mu.Unlock()
+	if s.live != nil {
+		s.live.errors.Add(int64(n))
+	}
+	errorsTotal.Add(float64(n))
+}
+
+func (s *Stats) addParseError(err error) {
+	s.mu.Lock()
+	s.ParseErrors++
+	switch {
+	case errors.Is(err, ErrTooFewApps):
+		s.TooFewApps++
+	case errors.Is(err, ErrTooManyApps):
+		s.TooManyApps++
+	}
+	s.mu.Unlock()
+	s.addErrors("", 1)
+}
+
+func (s *Stats) addSkipped(n int) {
+	s.mu.Lock()
+	s.SkippedExisting += n
+	s.mu.Unlock()
+}
+
+// wantsSize reports whether a record of size bytes would be among the n
+// largest, so its key only has to be built if so.
+func (s *Stats) wantsSize(n, size int) bool {
+	if n <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.largest == nil || s.largest.wants(size)
+}
+
+func (s *Stats) addRecordSize(n int, key string, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.largest == nil {
+		s.largest = &topSizes{n: n}
+	}
+	s.largest.add(RecordSize{Key: key, Bytes: size})
+}
+
+// Largest returns the largest serialized records seen, largest first.
+func (s *Stats) Largest() []RecordSize {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.largest == nil {
+		return nil
+	}
+	return s.largest.sorted()
+}
+
+func (s *Stats) addFilteredOut() {
+	s.mu.Lock()
+	s.FilteredOut++
+	s.mu.Unlock()
+}
+
+func (s *Stats) addSampledOut() {
+	s.mu.Lock()
+	s.SampledOut++
+	s.mu.Unlock()
+}
+
+func (s *Stats) addDiff(stored, written []byte, found bool) {
+	s.mu.Lock()
+	switch {
+	case !found:
+		s.DiffNew++
+	case bytes.Equal(stored, written):
+		s.DiffUnchanged++
+	default:
+		s.DiffChanged++
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stats) addTooLarge() {
+	s.mu.Lock()
+	s.TooLarge++
+	s.mu.Unlock()
+}
+
+func (s *Stats) addTooLargeTruncated() {
+	s.mu.Lock()
+	s.TooLargeTruncated++
+	s.mu.Unlock()
+}
+
+func (s *Stats) addVerifyFailure() {
+	s.mu.Lock()
+	s.VerifyFailures++
+	s.mu.Unlock()
+}
+
+// Unknown device types count as errors but not towards any type's stats.
+func (s *Stats) addUnknownType(devType string) {
+	s.mu.Lock()
+	if s.UnknownTypes == nil {
+		s.UnknownTypes = make(map[string]int)
+	}
+	s.UnknownTypes[devType]++
+	s.mu.Unlock()
+	s.addErrors("", 1)
+}
+
+func (s *Stats) counts() (processed, errors int) {
+	if s.live != nil {
+		return int(s.live.processed.Load()), int(s.live.errors.Load())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Processed, s.Errors
+}
+
+func (s *Stats) Add(other *Stats) {
+	s.mu.Lock()
+	s.Processed += other.Processed
+	s.Errors += other.Errors
+	s.ParseErrors += other.ParseErrors
+	s.TooFewApps += other.TooFewApps
+	s.TooManyApps += other.TooManyApps
+	s.VerifyFailures += other.VerifyFailures
+	s.SkippedExisting += other.SkippedExisting
+	s.SampledOut += other.SampledOut
+	s.FilteredOut += other.FilteredOut
+	if other.largest != nil {
+		if s.largest == nil {
+			s.largest = &topSizes{n: other.largest.n}
+		}
+		for _, r := range other.largest.items {
+			s.largest.add(r)
+		}
+	}
+	s.DiffNew += other.DiffNew
+	s.DiffChanged += other.DiffChanged
+	s.DiffUnchanged += other.DiffUnchanged
+	s.TooLarge += other.TooLarge
+	s.TooLargeTruncated += other.TooLargeTruncated
+	for devType, n := range other.UnknownTypes {
+		if s.UnknownTypes == nil {
+			s.UnknownTypes = make(map[string]int)
+		}
+		s.UnknownTypes[devType] += n
+	}
+	for devType, ts := range other.ByType {
+		dst := s.typeStats(devType)
+		dst.Processed += ts.Processed
+		dst.Errors += ts.Errors
+		dst.Bytes += ts.Bytes
+		for i, n := range ts.SetLatency {
+			dst.SetLatency[i] += n
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stats) WriteDryRunReport(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devTypes := make([]string, 0, len(s.ByType))
+	for devType := range s.ByType {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "DEV TYPE\tRECORDS\tBYTES\t")
+	var records, bytes int
+	for _, devType := range devTypes {
+		ts := s.ByType[devType]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t\n", devType, ts.Processed, ts.Bytes)
+		records += ts.Processed
+		bytes += ts.Bytes
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t\n", records, bytes)
+	tw.Flush()
+	fmt.Fprintf(w, "Failed to parse: %d\n", s.ParseErrors)
+}
@@ -0,0 +1,81 @@
+package loader
+
+import (
+	"fmt"
+	"testing"
+)
+
+// BenchmarkStatsParallel counts records from parallel workers into one
+// shared Stats, into worker-local ones merged at the end, and into
+// worker-local ones updated once per batch of 1000 as flushes do. Run with
+// -cpu 16 or more to see contention.
+func BenchmarkStatsParallel(b *testing.B) {
+	const batch = 1000
+	b.Run("shared", func(b *testing.B) {
+		stats := Stats{live: &liveCounts{}}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				stats.addProcessed("idfa", 1)
+				stats.addBytes("idfa", 100)
+			}
+		})
+	})
+	b.Run("worker-local", func(b *testing.B) {
+		stats := Stats{live: &liveCounts{}}
+		b.RunParallel(func(pb *testing.PB) {
+			local := stats.workerStats()
+			for pb.Next() {
+				local.addProcessed("idfa", 1)
+				local.addBytes("idfa", 100)
+			}
+			stats.Add(local)
+		})
+	})
+	b.Run("worker-local-batched", func(b *testing.B) {
+		stats := Stats{live: &liveCounts{}}
+		b.RunParallel(func(pb *testing.PB) {
+			local := stats.workerStats()
+			var counts writeCounts
+			for pb.Next() {
+				counts.processed++
+				counts.bytes += 100
+				if counts.processed == batch {
+					local.addWrites("idfa", counts)
+					counts = writeCounts{}
+				}
+			}
+			local.addWrites("idfa", counts)
+			stats.Add(local)
+		})
+	})
+}
+
+// Merging worker-local stats gives the same totals as counting into one.
+func TestStatsAddTotals(t *testing.T) {
+	var shared Stats
+	total := Stats{live: &liveCounts{}}
+	for w := range 4 {
+		local := total.workerStats()
+		for i := range 100 {
+			devType := fmt.Sprintf("type%d", i%3)
+			counts := writeCounts{processed: 1, bytes: w + i}
+			if i%10 == 0 {
+				counts = writeCounts{errors: 1}
+			}
+			local.addWrites(devType, counts)
+			shared.addWrites(devType, counts)
+		}
+		total.Add(local)
+	}
+	if total.Processed != shared.Processed || total.Errors != shared.Errors {
+		t.Errorf("merged processed %d, errors %d; shared %d, %d", total.Processed, total.Errors, shared.Processed, shared.Errors)
+	}
+	if int(total.live.processed.Load()) != total.Processed || int(total.live.errors.Load()) != total.Errors {
+		t.Errorf("live counts %d, %d, want %d, %d", total.live.processed.Load(), total.live.errors.Load(), total.Processed, total.Errors)
+	}
+	for devType, ts := range shared.ByType {
+		if got := total.ByType[devType]; got.Processed != ts.Processed || got.Errors != ts.Errors || got.Bytes != ts.Bytes {
+			t.Errorf("%s merged %+v, shared %+v", devType, *got, *ts)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package loader
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// RecordSize is the key and serialized size of a record.
+type RecordSize struct {
+	Key   string `json:"key"`
+	Bytes int    `json:"bytes"`
+}
+
+// topSizes keeps the n largest records seen in a min-heap, so the smallest
+// of them is the one to compare with and replace.
+type topSizes struct {
+	n     int
+	items sizeHeap
+}
+
+type sizeHeap []RecordSize
+
+func (h sizeHeap) Len() int           { return len(h) }
+func (h sizeHeap) Less(i, j int) bool { return h[i].Bytes < h[j].Bytes }
+func (h sizeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x any)        { *h = append(*h, x.(RecordSize)) }
+func (h *sizeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (t *topSizes) wants(size int) bool {
+	return len(t.items) < t.n || size > t.items[0].Bytes
+}
+
+func (t *topSizes) add(r RecordSize) {
+	switch {
+	case len(t.items) < t.n:
+		heap.Push(&t.items, r)
+	case r.Bytes > t.items[0].Bytes:
+		t.items[0] = r
+		heap.Fix(&t.items, 0)
+	}
+}
+
+// sorted returns the records largest first.
+func (t *topSizes) sorted() []RecordSize {
+	out := append([]RecordSize(nil), t.items...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
@@ -0,0 +1,308 @@
+package loader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+type recordWriter struct {
+	ctx       context.Context
+	logger    *slog.Logger
+	mcClients map[string]*memcache.Client
+	opts      Options
+	stats     *Stats
+	batches   map[string]*batch
+	cp        *checkpointer
+	sink      Sink
+	// step is the checkpoint step of the lines in the open batches.
+	step int
+}
+
+type batch struct {
+	items   []*memcache.Item
+	apps    []*AppsInstalled
+	lines   []inputLine
+	started time.Time
+}
+
+func newRecordWriter(ctx context.Context, logger *slog.Logger, mcClients map[string]*memcache.Client, opts Options, stats *Stats, cp *checkpointer) *recordWriter {
+	w := &recordWriter{
+		ctx:       ctx,
+		logger:    logger,
+		mcClients: mcClients,
+		opts:      opts,
+		stats:     stats,
+		batches:   make(map[string]*batch),
+		cp:        cp,
+		sink:      opts.Sink,
+	}
+	if w.sink == nil {
+		w.sink = newMemcacheSink(mcClients, opts, stats)
+	}
+	return w
+}
+
+func (w *recordWriter) write(apps *AppsInstalled, line inputLine) {
+	if w.opts.DryRun {
+		var data []byte
+		var err error
+		if w.opts.KeyPrinter != nil {
+			// Build the whole item so the key is exactly the one a load writes.
+			var item *memcache.Item
+			if item, err = w.newItem(*apps, line); err == nil {
+				data = item.Value
+				w.opts.KeyPrinter.print(item.Key, len(data))
+				w.noteSize(apps, item.Key, len(data))
+			}
+		} else if data, err = encodeRecord(*apps, w.opts); err == nil {
+			data = w.stamp(data, line)
+			w.noteSize(apps, "", len(data))
+		}
+		if err != nil {
+			w.logger.Error("Serialization error", "err", err)
+			w.stats.addErrors(apps.DevType, 1)
+			w.opts.DLQ.add("serialization: "+err.Error(), line.text)
+			return
+		}
+		if line.num < w.opts.DrySample {
+			w.logger.Info("Dry run - would insert", "record", fmt.Sprintf("%+v", *apps))
+		}
+		w.stats.addProcessed(apps.DevType, 1)
+		w.stats.addBytes(apps.DevType, len(data))
+		return
+	}
+
+	item, err := w.newItem(*apps, line)
+	if err != nil {
+		w.logger.Error("Serialization error", "err", err)
+		w.stats.addErrors(apps.DevType, 1)
+		w.opts.DLQ.add("serialization: "+err.Error(), line.text)
+		w.cp.lineFailed(line.num)
+		return
+	}
+	w.noteSize(apps, item.Key, len(item.Value))
+
+	if w.opts.VerifyOnly {
+		w.stats.addProcessed(apps.DevType, 1)
+		w.verify(apps.DevType, item)
+		return
+	}
+
+	if w.opts.Diff {
+		w.diff(apps.DevType, item, line)
+		return
+	}
+
+	if w.opts.BatchSize <= 1 {
+		err := insertItem(w.ctx, w.logger, w.target(apps.DevType), item, w.opts)
+		var counts writeCounts
+		w.finish(apps, item, line, err, &counts)
+		w.stats.addWrites(apps.DevType, counts)
+		return
+	}
+
+	if step := w.cp.step(line.num); step != w.step {
+		// The open batches hold the last lines of an earlier step, which
+		// can't commit until they are written.
+		w.flushAll()
+		w.step = step
+	}
+	b, ok := w.batches[apps.DevType]
+	if !ok {
+		b = &batch{}
+		w.batches[apps.DevType] = b
+	}
+	if len(b.items) == 0 {
+		b.started = time.Now()
+	}
+	b.items = append(b.items, item)
+	b.apps = append(b.apps, apps)
+	b.lines = append(b.lines, line)
+	if len(b.items) >= w.opts.BatchSize {
+		w.flush(apps.DevType)
+	}
+}
+
+func (w *recordWriter) flush(devType string) {
+	b := w.batches[devType]
+	if b == nil || len(b.items) == 0 {
+		return
+	}
+	defer func() {
+		b.items = b.items[:0]
+		b.apps = b.apps[:0]
+		b.lines = b.lines[:0]
+	}()
+	errs := flushBatch(w.ctx, w.target(devType), b.items, w.opts)
+	var counts writeCounts
+	var firstErr error
+	for i, err := range errs {
+		if w.finish(b.apps[i], b.items[i], b.lines[i], err, &counts) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	w.stats.addWrites(devType, counts)
+	if counts.errors > 0 {
+		w.logger.Error("Cannot write batch items to memcached", "dev_type", devType, "items", len(b.items),
+			"failed", counts.errors, "err", firstErr)
+	}
+}
+
+// finish counts the outcome err of writing item for line into counts, after
+// writing it again with fewer apps if memcached rejected it as too large,
+// and reports whether it failed.
+func (w *recordWriter) finish(apps *AppsInstalled, item *memcache.Item, line inputLine, err error, counts *writeCounts) (failed bool) {
+	if errors.Is(err, ErrItemTooLarge) {
+		var truncated *memcache.Item
+		if truncated, err = w.tooLarge(apps, item, line); err == nil {
+			item = truncated
+		}
+	}
+	switch {
+	case err != nil && w.ctx.Err() != nil:
+		// Cut short by the deadline. The input is left for retry, so the
+		// record is neither an error, dead-lettered nor checkpointed.
+		return false
+	case errors.Is(err, memcache.ErrNotStored):
+		counts.skipped++
+	case err == nil:
+		counts.processed++
+		counts.bytes += len(item.Value)
+		if w.sampleVerify() {
+			w.verify(apps.DevType, item)
+		}
+	default:
+		counts.errors++
+		w.opts.DLQ.add("memcached: "+err.Error(), line.text)
+		w.cp.lineFailed(line.num)
+		return true
+	}
+	w.cp.lineDone(line.num)
+	return false
+}
+
+// newItem builds the item of the record on line, see stamp.
+func (w *recordWriter) newItem(apps AppsInstalled, line inputLine) (*memcache.Item, error) {
+	item, err := newItem(apps, w.opts)
+	if err != nil {
+		return nil, err
+	}
+	item.Value = w.stamp(item.Value, line)
+	return item, nil
+}
+
+// stamp adds the WriteOrder of line to the header of a value with CAS.
+func (w *recordWriter) stamp(value []byte, line inputLine) []byte {
+	if !w.opts.CAS {
+		return value
+	}
+	return withOrder(value, WriteOrder{Epoch: w.opts.CASEpoch, Line: uint64(line.num)})
+}
+
+// noteSize offers a serialized record to the Options.TopSizes largest ones.
+// An empty key is built only if the record makes it in.
+func (w *recordWriter) noteSize(apps *AppsInstalled, key string, size int) {
+	if !w.stats.wantsSize(w.opts.TopSizes, size) {
+		return
+	}
+	if key == "" {
+		var err error
+		if key, err = itemKey(*apps, w.opts); err != nil {
+			return
+		}
+	}
+	w.stats.addRecordSize(w.opts.TopSizes, key, size)
+}
+
+// tooLarge reports an item memcached rejected for its size and, with
+// TruncateOversize, writes the record again with fewer apps. It returns the
+// item written or the error to count the record as failed.
+func (w *recordWriter) tooLarge(apps *AppsInstalled, item *memcache.Item, line inputLine) (*memcache.Item, error) {
+	w.stats.addTooLarge()
+	w.logger.Warn("Item too large for memcached", "key", item.Key, "value_bytes", len(item.Value), "apps", len(apps.Apps))
+	if !w.opts.TruncateOversize {
+		return nil, ErrItemTooLarge
+	}
+	truncated := truncateApps(*apps, len(item.Value))
+	smaller, err := w.newItem(truncated, line)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertItem(w.ctx, w.logger, w.target(apps.DevType), smaller, w.opts); err != nil {
+		return nil, err
+	}
+	w.stats.addTooLargeTruncated()
+	w.logger.Info("Wrote truncated item", "key", item.Key, "value_bytes", len(smaller.Value),
+		"apps", len(truncated.Apps), "apps_dropped", len(apps.Apps)-len(truncated.Apps))
+	return smaller, nil
+}
+
+func (w *recordWriter) target(devType string) Setter {
+	return sinkSetter{w.sink, devType}
+}
+
+// Only memcached can be read back.
+func (w *recordWriter) sampleVerify() bool {
+	return w.opts.VerifyRate > 0 && w.opts.Sink == nil && rand.Float64() < w.opts.VerifyRate
+}
+
+// verify reads a written item back to catch writes memcached accepted but
+// didn't keep. A verify-only run checks every record, so failures are logged
+// at debug level there.
+func (w *recordWriter) verify(devType string, item *memcache.Item) {
+	level := slog.LevelWarn
+	if w.opts.VerifyOnly {
+		level = slog.LevelDebug
+	}
+	got, err := w.mcClients[devType].Get(item.Key)
+	switch {
+	case errors.Is(err, memcache.ErrCacheMiss):
+		w.logger.Log(w.ctx, level, "Verification failed, key is missing", "key", item.Key)
+	case err != nil:
+		w.logger.Log(w.ctx, level, "Verification failed, cannot read key", "key", item.Key, "err", err)
+	case !bytes.Equal(got.Value, item.Value):
+		w.logger.Log(w.ctx, level, "Verification failed, value differs", "key", item.Key,
+			"written_bytes", len(item.Value), "stored_bytes", len(got.Value))
+	default:
+		return
+	}
+	w.stats.addVerifyFailure()
+}
+
+// diff compares item with the value stored under its key without writing.
+func (w *recordWriter) diff(devType string, item *memcache.Item, line inputLine) {
+	got, err := w.mcClients[devType].Get(item.Key)
+	switch {
+	case errors.Is(err, memcache.ErrCacheMiss):
+		w.stats.addDiff(nil, item.Value, false)
+	case err != nil:
+		w.logger.Error("Cannot read key", "key", item.Key, "err", err)
+		w.stats.addErrors(devType, 1)
+		w.opts.DLQ.add("cannot read from memcached", line.text)
+		return
+	default:
+		w.stats.addDiff(got.Value, item.Value, true)
+	}
+	w.stats.addProcessed(devType, 1)
+}
+
+func (w *recordWriter) flushStale() {
+	for devType, b := range w.batches {
+		if len(b.items) > 0 && time.Since(b.started) >= w.opts.BatchFlushInterval {
+			w.flush(devType)
+		}
+	}
+}
+
+func (w *recordWriter) flushAll() {
+	for devType := range w.batches {
+		w.flush(devType)
+	}
+}
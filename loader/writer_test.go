@@ -0,0 +1,121 @@
+package loader
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+func TestFlushBatch(t *testing.T) {
+	mc := newFakeSetter()
+	mc.items["idfa:2"] = []byte("stored")
+	mc.fail = func(key string, call int) error {
+		switch key {
+		case "idfa:3":
+			return memcache.ErrMalformedKey
+		case "idfa:4":
+			return serverError("SERVER_ERROR object too large for cache")
+		}
+		return nil
+	}
+	var items []*memcache.Item
+	for i := range 6 {
+		items = append(items, &memcache.Item{Key: fmt.Sprintf("idfa:%d", i), Value: []byte("v")})
+	}
+
+	errs := flushBatch(context.Background(), mc, items, Options{Mode: ModeAdd, BatchConcurrency: 3})
+	want := []error{nil, nil, memcache.ErrNotStored, memcache.ErrMalformedKey, ErrItemTooLarge, nil}
+	for i, err := range errs {
+		if want[i] == nil && err != nil || want[i] != nil && !errors.Is(err, want[i]) {
+			t.Errorf("item %d: err = %v, want %v", i, err, want[i])
+		}
+	}
+	for _, i := range []int{0, 1, 5} {
+		if _, ok := mc.value(items[i].Key); !ok {
+			t.Errorf("item %d was not written", i)
+		}
+	}
+}
+
+func TestFlushBatchCancelled(t *testing.T) {
+	mc := newFakeSetter()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	items := []*memcache.Item{{Key: "idfa:1"}, {Key: "idfa:2"}}
+	for i, err := range flushBatch(ctx, mc, items, Options{BatchConcurrency: 2}) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("item %d: err = %v, want context.Canceled", i, err)
+		}
+	}
+	if mc.callCount() != 0 {
+		t.Errorf("%d writes after cancel, want none", mc.callCount())
+	}
+}
+
+// A failed item of a batch is counted and dead-lettered on its own, the
+// others of the batch as written.
+func TestRecordWriterBatchItems(t *testing.T) {
+	mc := newFakeSetter()
+	mc.fail = func(key string, call int) error {
+		if key == "idfa:dev2" {
+			return memcache.ErrMalformedKey
+		}
+		return nil
+	}
+	dlqPath := filepath.Join(t.TempDir(), "dlq.gz")
+	dlq, err := OpenDeadLetterQueue(dlqPath, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{BatchSize: 4, BatchConcurrency: 2, Sink: mc, DLQ: dlq}
+	stats := &Stats{}
+	w := newRecordWriter(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), testClients, opts, stats, nil)
+	var lines []string
+	for i := range 4 {
+		line := fmt.Sprintf("idfa\tdev%d\t1\t2\t%d", i, i)
+		lines = append(lines, line)
+		apps, err := ParseAppsInstalled(line, ParseOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.write(apps, inputLine{num: i, text: line})
+	}
+	w.flushAll()
+	if err := dlq.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Processed != 3 || stats.Errors != 1 || stats.ByType["idfa"].Errors != 1 {
+		t.Errorf("processed %d, errors %d, idfa errors %d; want 3, 1, 1",
+			stats.Processed, stats.Errors, stats.ByType["idfa"].Errors)
+	}
+	if mc.len() != 3 {
+		t.Errorf("%d keys written, want 3", mc.len())
+	}
+	file, err := os.Open(dlqPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(dead) != 2 || !strings.HasPrefix(dead[0], "# memcached: ") || dead[1] != lines[2] {
+		t.Errorf("dead letters %q, want the reason and line of dev2 only", dead)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// newRunID returns a short random id telling apart the log lines and
+// summaries of overlapping runs.
+func newRunID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// setupLogger adds runID to every line, right after the message.
+func setupLogger(format string, level slog.Leveler, runID string) error {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 {
+				switch a.Key {
+				case slog.TimeKey:
+					a.Key = "timestamp"
+				case slog.MessageKey:
+					a.Key = "message"
+				}
+			}
+			return a
+		}
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(handler.WithAttrs([]slog.Attr{slog.String("run_id", runID)})))
+	return nil
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// readManifest returns the paths listed one per line, in order. Blank lines
+// and lines starting with # are skipped. Listed files are not checked here:
+// a missing one fails in ProcessFile and is reported like any other failure.
+func readManifest(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	return files, scanner.Err()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const defaultOrder = "name-asc"
+
+type fileOrder struct {
+	by   string
+	desc bool
+}
+
+// parseOrder accepts name, mtime or size with an optional -asc or -desc
+// suffix; ascending is the default.
+func parseOrder(s string) (fileOrder, error) {
+	by, dir, _ := strings.Cut(s, "-")
+	order := fileOrder{by: by}
+	switch dir {
+	case "", "asc":
+	case "desc":
+		order.desc = true
+	default:
+		return order, fmt.Errorf("invalid -order %q, want name, mtime or size with -asc or -desc", s)
+	}
+	switch by {
+	case "name", "mtime", "size":
+	default:
+		return order, fmt.Errorf("invalid -order %q, want name, mtime or size with -asc or -desc", s)
+	}
+	return order, nil
+}
+
+// sortFiles orders files in place. A file that can't be stat'ed sorts as if
+// empty and old; it fails later when it's processed.
+func sortFiles(files []string, order fileOrder) {
+	infos := make(map[string]os.FileInfo, len(files))
+	if order.by != "name" {
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				infos[file] = info
+			}
+		}
+	}
+	key := func(file string) (int64, string) {
+		info := infos[file]
+		switch {
+		case info == nil:
+			return 0, file
+		case order.by == "mtime":
+			return info.ModTime().UnixNano(), file
+		case order.by == "size":
+			return info.Size(), file
+		}
+		return 0, file
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if order.desc {
+			a, b = b, a
+		}
+		ka, na := key(a)
+		kb, nb := key(b)
+		if ka != kb {
+			return ka < kb
+		}
+		return na < nb
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"go_multithreading/loader"
+)
+
+type runSummary struct {
+	RunID          string                 `json:"run_id"`
+	Success        bool                   `json:"success"`
+	Status         string                 `json:"status"`
+	Processed      int                    `json:"processed"`
+	Errors         int                    `json:"errors"`
+	Bytes          int                    `json:"bytes"`
+	ErrRate        float64                `json:"err_rate"`
+	ErrRateLimit   float64                `json:"err_rate_threshold"`
+	FilesProcessed int                    `json:"files_processed"`
+	FilesSkipped   int                    `json:"files_skipped"`
+	FilesFailed    int                    `json:"files_failed"`
+	FilesCorrupt   int                    `json:"files_decompress_failed"`
+	FilesEmpty     int                    `json:"files_empty"`
+	Skipped        int                    `json:"skipped_existing,omitempty"`
+	TooFewApps     int                    `json:"too_few_apps,omitempty"`
+	TooManyApps    int                    `json:"too_many_apps,omitempty"`
+	TooLarge       int                    `json:"items_too_large,omitempty"`
+	Truncated      int                    `json:"items_truncated,omitempty"`
+	ElapsedSeconds float64                `json:"elapsed_seconds"`
+	ByType         map[string]typeSummary `json:"by_type"`
+	Largest        []loader.RecordSize    `json:"largest_records,omitempty"`
+	Files          []*loader.Result       `json:"files"`
+}
+
+type typeSummary struct {
+	Processed int     `json:"processed"`
+	Errors    int     `json:"errors"`
+	Bytes     int     `json:"bytes"`
+	AvgBytes  float64 `json:"avg_bytes"`
+	// SetLatency counts memcached writes per duration bucket.
+	SetLatency map[string]int `json:"set_latency,omitempty"`
+}
+
+func totalStats(files []*loader.Result) *loader.Stats {
+	total := &loader.Stats{}
+	for _, f := range files {
+		total.Add(f.Stats)
+	}
+	return total
+}
+
+// File outcomes, as the run summary and log count them.
+const (
+	outcomeProcessed = "processed"
+	outcomeEmpty     = "empty"
+	outcomeSkipped   = "skipped"
+	outcomeFailed    = "failed"
+)
+
+// fileOutcome says how f counts towards the run: files left in place by
+// -warn-empty as empty, interrupted and skipped files as skipped, files that
+// failed or exceeded -err-rate as failed.
+func fileOutcome(f *loader.Result) string {
+	switch f.Status {
+	case loader.StatusOK:
+		return outcomeProcessed
+	case loader.StatusEmpty:
+		return outcomeEmpty
+	case loader.StatusInterrupted, loader.StatusSkipped:
+		return outcomeSkipped
+	default:
+		return outcomeFailed
+	}
+}
+
+// Files that were interrupted or never started, e.g. after -fail-fast or a
+// signal, count as skipped; those that failed or exceeded -err-rate as failed.
+// Files -warn-empty leaves in place count only as empty and do not fail the
+// run.
+// Only files interrupted by a signal or the deadline make the run
+// interrupted; those -fail-fast cut short leave it failed. The run fails as
+// well if its overall error rate reaches errRate.
+func newRunSummary(total *loader.Stats, files []*loader.Result, matched int, elapsed time.Duration, interrupted bool, errRate float64) runSummary {
+	success := true
+	var processed, skipped, failed, corrupt, empty int
+	for _, f := range files {
+		if f.Empty {
+			empty++
+		}
+		if f.DecompressError {
+			corrupt++
+		}
+		if f.Status == loader.StatusInterrupted {
+			interrupted = true
+		}
+		switch fileOutcome(f) {
+		case outcomeProcessed:
+			processed++
+		case outcomeEmpty:
+			// Counted by f.Empty; a warning, not a failure.
+		case outcomeSkipped:
+			skipped++
+			success = false
+		default:
+			failed++
+			success = false
+		}
+	}
+	skipped += max(matched-len(files), 0)
+	var rate float64
+	if attempted := total.Processed + total.SkippedExisting + total.Errors; attempted > 0 {
+		rate = float64(total.Errors) / float64(attempted)
+		if rate >= errRate {
+			success = false
+		}
+	}
+	status := loader.StatusOK
+	switch {
+	case interrupted:
+		status, success = loader.StatusInterrupted, false
+	case !success:
+		status = loader.StatusFailed
+	}
+	byType := make(map[string]typeSummary, len(total.ByType))
+	bytes := 0
+	for devType, ts := range total.ByType {
+		bytes += ts.Bytes
+		summary := typeSummary{Processed: ts.Processed, Errors: ts.Errors, Bytes: ts.Bytes}
+		if ts.Processed > 0 {
+			summary.AvgBytes = float64(ts.Bytes) / float64(ts.Processed)
+		}
+		for i, n := range ts.SetLatency {
+			if n == 0 {
+				continue
+			}
+			if summary.SetLatency == nil {
+				summary.SetLatency = make(map[string]int, loader.NumLatencyBuckets)
+			}
+			summary.SetLatency[loader.LatencyBucketNames[i]] = n
+		}
+		byType[devType] = summary
+	}
+	return runSummary{
+		Success:        success,
+		Status:         status,
+		Processed:      total.Processed,
+		Errors:         total.Errors,
+		Bytes:          bytes,
+		ErrRate:        rate,
+		ErrRateLimit:   errRate,
+		FilesProcessed: processed,
+		FilesSkipped:   skipped,
+		FilesFailed:    failed,
+		FilesEmpty:     empty,
+		FilesCorrupt:   corrupt,
+		Skipped:        total.SkippedExisting,
+		TooFewApps:     total.TooFewApps,
+		TooManyApps:    total.TooManyApps,
+		TooLarge:       total.TooLarge,
+		Truncated:      total.TooLargeTruncated,
+		ElapsedSeconds: elapsed.Seconds(),
+		ByType:         byType,
+		Largest:        total.Largest(),
+		Files:          files,
+	}
+}
+
+func logTypeBytes(summary runSummary) {
+	devTypes := make([]string, 0, len(summary.ByType))
+	for devType := range summary.ByType {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+	for _, devType := range devTypes {
+		ts := summary.ByType[devType]
+		slog.Info("Bytes written", "dev_type", devType, "records", ts.Processed, "bytes", ts.Bytes, "avg_bytes", ts.AvgBytes)
+	}
+}
+
+func logLargest(summary runSummary) {
+	for _, r := range summary.Largest {
+		slog.Info("Large record", "key", r.Key, "bytes", r.Bytes)
+	}
+}
+
+func logSetLatency(summary runSummary) {
+	devTypes := make([]string, 0, len(summary.ByType))
+	for devType := range summary.ByType {
+		devTypes = append(devTypes, devType)
+	}
+	sort.Strings(devTypes)
+	for _, devType := range devTypes {
+		latency := summary.ByType[devType].SetLatency
+		if len(latency) == 0 {
+			continue
+		}
+		attrs := []any{"dev_type", devType}
+		for _, name := range loader.LatencyBucketNames {
+			attrs = append(attrs, name, latency[name])
+		}
+		slog.Info("Set latency", attrs...)
+	}
+}
+
+// summaryWriter writes the -summary file once: either the final summary or,
+// if the run ends before that, the partial one from the deferred cleanup.
+type summaryWriter struct {
+	path    string
+	runID   string
+	written bool
+}
+
+func (w *summaryWriter) write(summary runSummary) error {
+	if w.path == "" || w.written {
+		return nil
+	}
+	w.written = true
+	summary.RunID = w.runID
+	return writeSummary(w.path, summary)
+}
+
+func writeSummary(path string, summary runSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"go_multithreading/loader"
+)
+
+func TestRunSummaryStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []string
+		interrupted bool
+		want        string
+		skipped     int
+		failed      int
+	}{
+		{"all ok", []string{loader.StatusOK, loader.StatusOK}, false, loader.StatusOK, 0, 0},
+		{"failed file", []string{loader.StatusOK, loader.StatusHighErrorRate}, false, loader.StatusFailed, 0, 1},
+		// -fail-fast cut the second file short: the run failed, it was not
+		// interrupted.
+		{"fail-fast", []string{loader.StatusFailed, loader.StatusSkipped}, false, loader.StatusFailed, 1, 1},
+		{"signal", []string{loader.StatusOK, loader.StatusInterrupted}, false, loader.StatusInterrupted, 1, 0},
+		{"signal before any file", nil, true, loader.StatusInterrupted, 0, 0},
+		// -warn-empty leaves the file in place but the run still succeeds.
+		{"empty warning", []string{loader.StatusOK, loader.StatusEmpty}, false, loader.StatusOK, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []*loader.Result
+			for _, status := range tt.statuses {
+				files = append(files, &loader.Result{Status: status, Stats: &loader.Stats{}})
+			}
+			summary := newRunSummary(totalStats(files), files, len(files), 0, tt.interrupted, loader.DefaultErrRate)
+			if summary.Status != tt.want || summary.Success != (tt.want == loader.StatusOK) {
+				t.Errorf("status %s, success %v; want %s", summary.Status, summary.Success, tt.want)
+			}
+			if summary.FilesSkipped != tt.skipped || summary.FilesFailed != tt.failed {
+				t.Errorf("skipped %d, failed %d; want %d and %d", summary.FilesSkipped, summary.FilesFailed, tt.skipped, tt.failed)
+			}
+		})
+	}
+}
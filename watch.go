@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFiles sends the initial files, then every file of dir whose name
+// matches pattern once it has gone settle without being written to, until
+// ctx is done. Dot-prefixed names, which is how loaded files are renamed,
+// are ignored.
+func watchFiles(ctx context.Context, dir, pattern string, settle time.Duration, initial []string) (<-chan string, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	slog.Info("Watching for new files", "dir", dir, "pattern", pattern, "settle", settle.String())
+
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer watcher.Close()
+		queue := initial
+		// lastWrite holds the files not yet settled and when they last changed.
+		lastWrite := make(map[string]time.Time)
+		ticker := time.NewTicker(max(settle/4, 10*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			var send chan string
+			var next string
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case send <- next:
+				queue = queue[1:]
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if strings.HasPrefix(name, ".") {
+					continue
+				}
+				if ok, _ := filepath.Match(pattern, name); !ok {
+					continue
+				}
+				switch {
+				case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+					lastWrite[event.Name] = time.Now()
+				case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+					delete(lastWrite, event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Directory watch error", "dir", dir, "err", err)
+			case now := <-ticker.C:
+				var settled []string
+				for path, t := range lastWrite {
+					if now.Sub(t) >= settle {
+						delete(lastWrite, path)
+						settled = append(settled, path)
+					}
+				}
+				sort.Strings(settled)
+				for _, path := range settled {
+					slog.Info("New file", "file", path)
+				}
+				queue = append(queue, settled...)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}